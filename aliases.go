@@ -0,0 +1,168 @@
+package applysabun
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// 同じものを指す別名のグループの辞書
+// 複数の名義で活動するアーティストや、漢字とローマ字の両方の表記があるタイトルは、編集距離では一致させられない
+type aliasDictionary struct {
+	groups    [][]string
+	groupMap  map[string]int // 正規化した名前 -> groupsのインデックス
+	normalize func(string) string
+}
+
+func newAliasDictionary(groups [][]string, normalize func(string) string) *aliasDictionary {
+	d := aliasDictionary{groups: groups, groupMap: map[string]int{}, normalize: normalize}
+	for i, group := range groups {
+		for _, name := range group {
+			if key := d.key(name); key != "" {
+				d.groupMap[key] = i
+			}
+		}
+	}
+	return &d
+}
+
+func (d *aliasDictionary) key(name string) string {
+	if d.normalize != nil {
+		name = d.normalize(name)
+	}
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+// 2つの名前が同じグループに属するか。同じ名前はグループに関係なくtrue
+func (d *aliasDictionary) isSame(a, b string) bool {
+	keyA, keyB := d.key(a), d.key(b)
+	if keyA == "" || keyB == "" {
+		return false
+	}
+	if keyA == keyB {
+		return true
+	}
+	i, okA := d.groupMap[keyA]
+	j, okB := d.groupMap[keyB]
+	return okA && okB && i == j
+}
+
+// 名前と同じグループの、他の名前を返す
+func (d *aliasDictionary) aliases(name string) []string {
+	key := d.key(name)
+	i, ok := d.groupMap[key]
+	if !ok {
+		return nil
+	}
+	aliases := []string{}
+	for _, alias := range d.groups[i] {
+		if d.key(alias) != key {
+			aliases = append(aliases, alias)
+		}
+	}
+	return aliases
+}
+
+// 設定の別名辞書から作った、タイトルとアーティストの辞書
+type aliasDictionaries struct {
+	titles  *aliasDictionary
+	artists *aliasDictionary
+}
+
+func newAliasDictionaries(config *Config, normalizer *titleNormalizer) *aliasDictionaries {
+	if config == nil {
+		config = DefaultConfig()
+	}
+	return &aliasDictionaries{
+		titles:  newAliasDictionary(config.TitleAliases, normalizer.normalize),
+		artists: newAliasDictionary(config.ArtistAliases, nil),
+	}
+}
+
+// ProposeAliasesが提案する別名のグループ。設定ファイルのartist_aliases・title_aliasesにそのまま追加できる
+type AliasProposal struct {
+	ArtistAliases [][]string `json:"artist_aliases"`
+	TitleAliases  [][]string `json:"title_aliases"`
+}
+
+// 同じ楽曲とみなす楽曲フォルダの、WAV定義の音源名の最小数。少ないと汎用的な音源だけの一致を拾う
+const aliasProposalMinKeysoundNum = 16
+
+// ライブラリから、WAV定義の音源名の集合が完全に同じなのにアーティストやタイトルが異なる楽曲フォルダを探し、別名として提案する
+// 設定の辞書で既に同じグループにある名前は提案しない
+func ProposeAliases(db *sqlx.DB, config *Config) (*AliasProposal, error) {
+	normalizer, err := newTitleNormalizer(config)
+	if err != nil {
+		return nil, err
+	}
+	dictionaries := newAliasDictionaries(config, normalizer)
+
+	songs, err := newSQLSongSource(db)
+	if err != nil {
+		return nil, err
+	}
+	folders, keysoundsList, err := scanLibraryKeysounds(songs)
+	if err != nil {
+		return nil, fmt.Errorf("Failed scanLibraryKeysounds: %w", err)
+	}
+	foldersByKeysounds := map[string][]int{}
+	keys := []string{}
+	for i, keysounds := range keysoundsList {
+		if len(keysounds) < aliasProposalMinKeysoundNum {
+			continue
+		}
+		key := strings.Join(keysounds, "\n")
+		if _, ok := foldersByKeysounds[key]; !ok {
+			keys = append(keys, key)
+		}
+		foldersByKeysounds[key] = append(foldersByKeysounds[key], i)
+	}
+	sort.Strings(keys)
+
+	// 既に同じグループの名前は1つにまとめ、2つ以上残れば提案する
+	propose := func(names []string, d *aliasDictionary) []string {
+		group := []string{}
+		for _, name := range names {
+			if strings.TrimSpace(name) == "" {
+				continue
+			}
+			isKnown := false
+			for _, n := range group {
+				if d.isSame(n, name) {
+					isKnown = true
+					break
+				}
+			}
+			if !isKnown {
+				group = append(group, name)
+			}
+		}
+		if len(group) < 2 {
+			return nil
+		}
+		return group
+	}
+
+	proposal := AliasProposal{ArtistAliases: [][]string{}, TitleAliases: [][]string{}}
+	for _, key := range keys {
+		indices := foldersByKeysounds[key]
+		if len(indices) < 2 {
+			continue
+		}
+		artists, titles := []string{}, []string{}
+		for _, i := range indices {
+			chart := folders[i].Charts[0]
+			artists = append(artists, chart.Artist)
+			titles = append(titles, normalizer.normalize(chart.Title))
+		}
+		if group := propose(artists, dictionaries.artists); group != nil {
+			proposal.ArtistAliases = append(proposal.ArtistAliases, group)
+		}
+		if group := propose(titles, dictionaries.titles); group != nil {
+			proposal.TitleAliases = append(proposal.TitleAliases, group)
+		}
+	}
+	return &proposal, nil
+}
@@ -2,6 +2,7 @@ package applysabun
 
 import (
 	"fmt"
+	"math"
 	"os"
 	"path/filepath"
 	"reflect"
@@ -9,7 +10,6 @@ import (
 	"time"
 
 	"github.com/Shimi9999/gobms"
-	"github.com/hbollon/go-edlib"
 	"github.com/jmoiron/sqlx"
 	_ "modernc.org/sqlite"
 )
@@ -25,6 +25,7 @@ func OpenSongdb(path string) (*sqlx.DB, error) {
 	if err != nil {
 		return nil, fmt.Errorf("There is no song table in the DB.")
 	}
+	defer rows.Close()
 	cols, err := rows.Columns()
 	if err != nil {
 		return nil, fmt.Errorf("Columns error: %w", err)
@@ -79,6 +80,9 @@ func retryableQuery(db *sqlx.DB, query string, args ...interface{}) (*sqlx.Rows,
 type SabunInfo struct {
 	BmsData                  *gobms.BmsData
 	AdditionalSoundFilePaths []string
+	AssetFilePaths           []string     // #STAGEFILE等のヘッダで参照される画像やpreview音源
+	ReadmeHints              *ReadmeHints // 同じディレクトリのreadmeから読み取ったヒント。なければnil
+	SabunDirPath             string       // WalkSabunDirに渡した差分ディレクトリ。タイトルの候補にする親ディレクトリはこの下まで
 	LoadingError             error
 	TargetSearchResult       *SearchResult
 }
@@ -103,6 +107,7 @@ func WalkSabunDir(sabunDirPath string) (sabunInfos []SabunInfo, _ error) {
 			return nil, fmt.Errorf("walkSabunDir %s: %w", sabunDirPath, infoWithIndex.Error)
 		}
 		sabunInfos[infoWithIndex.Index] = *infoWithIndex.SabunInfo
+		sabunInfos[infoWithIndex.Index].SabunDirPath = sabunDirPath
 	}
 
 	return sabunInfos, nil
@@ -114,9 +119,10 @@ func _walkSabunDir(infoCh chan *sabunInfoWithIndex, sabunDirPath string, sabunIn
 		return fmt.Errorf("ReadDir: %w", err)
 	}
 
-	// 直下の差分、直下の音源ファイル
+	// 直下の差分、直下の音源ファイル、直下のその他ファイル
 	underDirSabunPaths := []string{}
 	underDirSoundFilePaths := []string{}
+	underDirOtherFilePaths := []string{}
 
 	for _, file := range files {
 		path := filepath.Join(sabunDirPath, file.Name())
@@ -129,6 +135,8 @@ func _walkSabunDir(infoCh chan *sabunInfoWithIndex, sabunDirPath string, sabunIn
 			underDirSabunPaths = append(underDirSabunPaths, path)
 		} else if isBmsSoundPath(path) {
 			underDirSoundFilePaths = append(underDirSoundFilePaths, path)
+		} else {
+			underDirOtherFilePaths = append(underDirOtherFilePaths, path)
 		}
 	}
 
@@ -140,7 +148,7 @@ func _walkSabunDir(infoCh chan *sabunInfoWithIndex, sabunDirPath string, sabunIn
 		sabunPath := udSabunPath
 		index := len(*sabunInfos) - 1
 		go func() {
-			_sabunInfo, err := makeSabunInfo(sabunPath, underDirSoundFilePaths)
+			_sabunInfo, err := makeSabunInfo(sabunPath, underDirSoundFilePaths, underDirOtherFilePaths)
 			if err != nil {
 				err = fmt.Errorf("makeSabunInfo: %w", err)
 			}
@@ -152,7 +160,7 @@ func _walkSabunDir(infoCh chan *sabunInfoWithIndex, sabunDirPath string, sabunIn
 	return nil
 }
 
-func makeSabunInfo(sabunPath string, soundFilePaths []string) (*SabunInfo, error) {
+func makeSabunInfo(sabunPath string, soundFilePaths, otherFilePaths []string) (*SabunInfo, error) {
 	bmsData, err := loadBms(sabunPath)
 	if err != nil {
 		if strings.HasPrefix(err.Error(), "Timeout LoadBms: ") {
@@ -179,12 +187,60 @@ func makeSabunInfo(sabunPath string, soundFilePaths []string) (*SabunInfo, error
 		}
 	}
 
+	assetFilePaths, err := findAssetFilePaths(sabunPath, soundFilePaths, otherFilePaths)
+	if err != nil {
+		return nil, fmt.Errorf("findAssetFilePaths %s: %w", sabunPath, err)
+	}
+
 	return &SabunInfo{
 		BmsData:                  bmsData,
 		AdditionalSoundFilePaths: additionalSoundFilePaths,
+		AssetFilePaths:           assetFilePaths,
+		ReadmeHints:              readReadmeHints(otherFilePaths),
 		LoadingError:             nil}, nil
 }
 
+// ヘッダで参照される画像ファイルやpreview音源ファイルのうち、差分と同じディレクトリにあるものを返す
+func findAssetFilePaths(sabunPath string, soundFilePaths, otherFilePaths []string) ([]string, error) {
+	scan, err := scanBms(sabunPath)
+	if err != nil {
+		return nil, fmt.Errorf("scanBms: %w", err)
+	}
+
+	assetFilePaths := []string{}
+	appendUnique := func(path string) {
+		for _, p := range assetFilePaths {
+			if p == path {
+				return
+			}
+		}
+		assetFilePaths = append(assetFilePaths, path)
+	}
+
+	// Windows由来の差分が多いので、ファイル名は大文字小文字を区別せずに照合する
+	dirFilePaths := append(append([]string{}, soundFilePaths...), otherFilePaths...)
+	for _, command := range []string{"stagefile", "banner", "backbmp", "preview"} {
+		value := strings.ReplaceAll(scan.Headers[command], "\\", "/")
+		if value == "" || strings.Contains(value, "/") {
+			continue
+		}
+		for _, path := range dirFilePaths {
+			if strings.EqualFold(filepath.Base(path), value) {
+				appendUnique(path)
+			}
+		}
+	}
+
+	// beatorajaはフォルダ内のpreview*.oggなどをプレビュー音源として再生する
+	for _, path := range soundFilePaths {
+		if strings.HasPrefix(strings.ToLower(filepath.Base(path)), "preview") {
+			appendUnique(path)
+		}
+	}
+
+	return assetFilePaths, nil
+}
+
 func getPureFileName(path string) string {
 	return filepath.Base(path[:len(path)-len(filepath.Ext(path))])
 }
@@ -229,10 +285,18 @@ func isBmsSoundPath(path string) bool {
 }
 
 type Chart struct {
-	Title  string `db:"title"`
-	Genre  string `db:"genre"`
-	Artist string `db:"artist"`
-	Path   string `db:"path"`
+	Title     string `db:"title"`
+	Subtitle  string `db:"subtitle"` // songテーブルにカラムがなければ空
+	Genre     string `db:"genre"`
+	Artist    string `db:"artist"`
+	Subartist string `db:"subartist"` // songテーブルにカラムがなければ空
+	Path      string `db:"path"`
+	// songテーブルにカラムがなければ0
+	MinBpm float64 `db:"minbpm"`
+	MaxBpm float64 `db:"maxbpm"`
+	Length int64   `db:"length"` // ミリ秒
+	// 複数のライブラリから探索した場合に、譜面があるライブラリのパス
+	Library string `db:"-"`
 }
 
 type MatchingLevel int
@@ -244,10 +308,13 @@ const (
 	ArtistConditional
 	Almost
 	Perfect
+	Manual // Overridesか設定のルールで移動先が指定された
 )
 
 func (m MatchingLevel) String() string {
 	switch m {
+	case Manual:
+		return "✎ Manual"
 	case Perfect:
 		return "★ Perfect"
 	case Almost:
@@ -266,20 +333,36 @@ func (m MatchingLevel) String() string {
 type MatchingSign string
 
 const (
-	OK    MatchingSign = "OK"
-	NG    MatchingSign = "NG"
-	EXIST MatchingSign = "EXIST"
-	ERROR MatchingSign = "ERROR"
+	OK        MatchingSign = "OK"
+	NG        MatchingSign = "NG"
+	EXIST     MatchingSign = "EXIST"
+	ERROR     MatchingSign = "ERROR"
+	AMBIGUOUS MatchingSign = "AMBIGUOUS" // 同程度に一致する楽曲フォルダが複数ある。自動では移動しない
 )
 
 type WavDefsMatchingResult struct {
 	MatchingNum  int
 	WavDefsNum   int
 	MatchingRate float64
+
+	// WAV定義のインデックスを無視し、参照される音源名の集合で比較した結果
+	// 定義を振り直した差分でも、同じ音源を使っていれば高くなる
+	SharedNameNum  int
+	SourceNameNum  int
+	TargetNameNum  int
+	SourceCoverage float64 // SharedNameNum / SourceNameNum
+	TargetCoverage float64 // SharedNameNum / TargetNameNum
+	Jaccard        float64 // SharedNameNum / (SourceNameNumとTargetNameNumの和集合の数)
 }
 
 func (r WavDefsMatchingResult) String() string {
-	return fmt.Sprintf("%d/%d,%.3f", r.MatchingNum, r.WavDefsNum, r.MatchingRate)
+	return fmt.Sprintf("%d/%d,%.3f names:%d/%d/%d,%.3f", r.MatchingNum, r.WavDefsNum, r.MatchingRate,
+		r.SharedNameNum, r.SourceNameNum, r.TargetNameNum, r.Jaccard)
+}
+
+// インデックスの一致と音源名の集合の一致のうち、高い方
+func (r WavDefsMatchingResult) BestRate() float64 {
+	return math.Max(r.MatchingRate, r.Jaccard)
 }
 
 // ソースBMSのWAV定義を基準に、ターゲットBMSのWAV定義との一致情報を返す
@@ -290,7 +373,31 @@ func matchingWavDefs(sourceBmsData, targetBmsData *gobms.UniqueBmsData) *WavDefs
 			r.MatchingNum++
 		}
 	}
-	r.MatchingRate = float64(r.MatchingNum) / float64(len(sourceBmsData.WavDefs))
+	if r.WavDefsNum > 0 {
+		r.MatchingRate = float64(r.MatchingNum) / float64(r.WavDefsNum)
+	}
+
+	sourceNames := keysoundNames(sourceBmsData.WavDefs)
+	targetNameMap := map[string]bool{}
+	for _, name := range keysoundNames(targetBmsData.WavDefs) {
+		targetNameMap[name] = true
+	}
+	for _, name := range sourceNames {
+		if targetNameMap[name] {
+			r.SharedNameNum++
+		}
+	}
+	r.SourceNameNum = len(sourceNames)
+	r.TargetNameNum = len(targetNameMap)
+	if r.SourceNameNum > 0 {
+		r.SourceCoverage = float64(r.SharedNameNum) / float64(r.SourceNameNum)
+	}
+	if r.TargetNameNum > 0 {
+		r.TargetCoverage = float64(r.SharedNameNum) / float64(r.TargetNameNum)
+	}
+	if unionNum := r.SourceNameNum + r.TargetNameNum - r.SharedNameNum; unionNum > 0 {
+		r.Jaccard = float64(r.SharedNameNum) / float64(unionNum)
+	}
 	return &r
 }
 
@@ -299,9 +406,44 @@ type SearchResult struct {
 	TargetBmsDirPath      string
 	MatchedBmsData        *gobms.BmsData
 	MatchingLevel         MatchingLevel
+	Confidence            float64       // MatchingLevelの元になった確信度 (0-1)
+	StringsMatchingLevel  MatchingLevel // WAV定義の一致による昇格・降格前のMatchingLevel
+	DecidedBy             DecisionEvidence
 	WavDefsMatchingResult *WavDefsMatchingResult
+	MissingFields         []string // 差分か選ばれた候補で空のため、比較しなかったフィールド
+	IsBelowMinConfidence  bool     // 候補は見つかったが、確信度がSearchOptions.MinConfidence未満のためNGにした
+	// Sign=AMBIGUOUSの場合に、同程度に一致した全ての楽曲フォルダ
+	AmbiguousTargetBmsDirPaths []string
+	// 複数のライブラリから探索した場合に、TargetBmsDirPathの譜面があるライブラリのパス
+	TargetLibrary string
+	// SearchOptions.KeysoundHash=trueの場合のみ使用
+	KeysoundHashMatchingResult *KeysoundHashMatchingResult
+	UsageProfileSimilarity     float64 // 小節ごとの音源配置の類似度 (0-1)
+	RetrievalSource            RetrievalSource
+	// MatchingLevel=Manualの場合に、一致したOverridesの指定
+	Override *OverrideEntry
+	// 移動先の振り分けやNGに使われた設定のルール
+	AppliedRules []string
+	// 差分と選ばれた候補のBPM・演奏時間。どちらかが不明ならnil
+	SabunMetrics  *ChartMetrics
+	TargetMetrics *ChartMetrics
+	// 差分と一致しないBPM・演奏時間の項目。別バージョンの楽曲フォルダの可能性がある
+	SuspiciousFields []string
 }
 
+// 候補の譜面をどの方法で見つけたか
+type RetrievalSource string
+
+const (
+	TitleRetrieval           RetrievalSource = "title"
+	KeysoundRetrieval        RetrievalSource = "keysound"
+	TitleHintRetrieval       RetrievalSource = "title-hint"      // 差分のファイル名・親ディレクトリ名から得たタイトル
+	FolderRetrieval          RetrievalSource = "folder"          // 楽曲フォルダ名
+	ReadmeRetrieval          RetrievalSource = "readme"          // 差分パックのreadmeに書かれた楽曲名
+	TransliterationRetrieval RetrievalSource = "transliteration" // かなとローマ字の書き分け
+	FuzzyRetrieval           RetrievalSource = "fuzzy"           // タイトルのtrigramの重なり
+)
+
 func (r SearchResult) String(sourceSabunInfo *SabunInfo) string {
 	str := fmt.Sprintf("%s: %s", r.Sign, sourceSabunInfo.BmsData.Path)
 	if r.Sign == ERROR {
@@ -311,158 +453,525 @@ func (r SearchResult) String(sourceSabunInfo *SabunInfo) string {
 			str += " -- something error"
 		}
 	} else {
-		if r.Sign != NG {
+		if r.Sign == AMBIGUOUS {
+			str += fmt.Sprintf(" -> ? [%s]", strings.Join(r.AmbiguousTargetBmsDirPaths, " | "))
+		} else if r.Sign != NG {
 			str += fmt.Sprintf(" -> %s", r.TargetBmsDirPath)
+			if r.TargetLibrary != "" {
+				str += fmt.Sprintf(" (Library: %s)", r.TargetLibrary)
+			}
 		}
-		if r.Sign != EXIST {
+		if r.IsBelowMinConfidence {
+			str += fmt.Sprintf(" (Matching: %s %.3f, below min confidence)", r.MatchingLevel, r.Confidence)
+		} else if (r.Sign == OK || r.Sign == AMBIGUOUS) && r.DecidedBy != "" {
+			str += fmt.Sprintf(" (Matching: %s %.3f, by %s)", r.MatchingLevel, r.Confidence, r.DecidedBy)
+		} else if r.Sign != EXIST {
 			str += fmt.Sprintf(" (Matching: %s)", r.MatchingLevel)
 		}
+		if len(r.MissingFields) > 0 && r.Sign != EXIST {
+			str += fmt.Sprintf(" (Missing: %s)", strings.Join(r.MissingFields, ","))
+		}
+		if r.Sign == OK && r.RetrievalSource != "" && r.RetrievalSource != TitleRetrieval {
+			str += fmt.Sprintf(" [by %s]", r.RetrievalSource)
+		}
+		if r.Sign == OK && r.KeysoundHashMatchingResult != nil {
+			str += fmt.Sprintf(" (Keysounds: %s)", r.KeysoundHashMatchingResult)
+		}
+		if r.Sign == OK && r.MatchedBmsData != nil {
+			str += fmt.Sprintf(" (Usage: %.3f)", r.UsageProfileSimilarity)
+		}
+		if (r.Sign == OK || r.Sign == AMBIGUOUS) && len(r.SuspiciousFields) > 0 {
+			str += fmt.Sprintf(" (Suspicious: %s, sabun %s / target %s)", strings.Join(r.SuspiciousFields, ","), r.SabunMetrics, r.TargetMetrics)
+		}
+		if len(r.AppliedRules) > 0 {
+			str += fmt.Sprintf(" (Rules: %s)", strings.Join(r.AppliedRules, "; "))
+		}
+		if r.Override != nil && r.Override.Comment != "" {
+			str += fmt.Sprintf(" (Override: %s)", r.Override.Comment)
+		}
+		if r.Sign != EXIST && !sourceSabunInfo.ReadmeHints.IsEmpty() {
+			str += fmt.Sprintf(" (Readme: %s)", sourceSabunInfo.ReadmeHints)
+		}
 	}
 	return str
 }
 
+// SearchBmsDirPathFromSDDBのオプション
+// 同じSearchOptionsを複数の探索で使い回すとキャッシュが共有される。並行して使うことはできない
+type SearchOptions struct {
+	KeysoundHash bool // 差分パックと候補の楽曲フォルダの音源ファイルの内容を比較し、候補選択に使う
+	// タイトルで候補が見つからない場合に、ライブラリ全体のWAV定義から作ったインデックスで楽曲フォルダを探す
+	// インデックスは最初に必要になった時に作る
+	KeysoundIndex bool
+	// 最良の候補の確信度がこれ未満ならNGにする
+	MinConfidence float64
+	// タイトル正規化の正規表現等。nilならDefaultConfig
+	Config *Config
+	// 探索の前に参照する、手動で指定された移動先
+	Overrides *Overrides
+	// 却下された移動先。候補から除く
+	Decisions *DecisionStore
+	// songテーブルを最初の探索で一度だけメモリに読み込み、以降の探索はSQLiteに問い合わせない
+	// DBファイルが更新されていれば読み込み直す
+	Preload bool
+
+	songSource        songSource
+	songLibraries     []SongLibrary
+	keysoundHashCache *keysoundHashCache
+	keysoundIndex     *keysoundIndex
+	rules             []*rule
+	aliases           *aliasDictionaries
+	transliterations  transliterationIndex
+	titleNgramIndex   *titleNgramIndex
+	titleNormalizer   *titleNormalizer
+}
+
+func (o *SearchOptions) hashCache() *keysoundHashCache {
+	if o.keysoundHashCache == nil {
+		o.keysoundHashCache = newKeysoundHashCache()
+	}
+	return o.keysoundHashCache
+}
+
+func (o *SearchOptions) getTitleNormalizer() (*titleNormalizer, error) {
+	if o.titleNormalizer == nil {
+		normalizer, err := newTitleNormalizer(o.Config)
+		if err != nil {
+			return nil, err
+		}
+		o.titleNormalizer = normalizer
+	}
+	return o.titleNormalizer, nil
+}
+
+func (o *SearchOptions) getAliases() (*aliasDictionaries, error) {
+	if o.aliases == nil {
+		normalizer, err := o.getTitleNormalizer()
+		if err != nil {
+			return nil, err
+		}
+		o.aliases = newAliasDictionaries(o.Config, normalizer)
+	}
+	return o.aliases, nil
+}
+
+// パスのないライブラリが1つなら、譜面のパスはsongテーブルのまま返す
+func (o *SearchOptions) getSongSource(libraries []SongLibrary) (songSource, error) {
+	if o.songSource != nil && !o.songSource.isStale() && len(o.songLibraries) == len(libraries) {
+		isSame := true
+		for i := range libraries {
+			if o.songLibraries[i] != libraries[i] {
+				isSame = false
+			}
+		}
+		if isSame {
+			return o.songSource, nil
+		}
+	}
+	sources := []songSource{}
+	for _, library := range libraries {
+		var source songSource
+		var err error
+		if o.Preload {
+			source, err = loadMemorySongSource(library.DB)
+		} else {
+			source, err = newSQLSongSource(library.DB)
+		}
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, source)
+	}
+	songs := sources[0]
+	if len(libraries) > 1 || libraries[0].Path != "" {
+		songs = newMultiSongSource(libraries, sources)
+	}
+	// DBから作ったインデックスは作り直す
+	o.songSource, o.songLibraries = songs, append([]SongLibrary{}, libraries...)
+	o.keysoundIndex, o.transliterations, o.titleNgramIndex = nil, nil, nil
+	return songs, nil
+}
+
+func (o *SearchOptions) getTransliterationIndex(songs songSource) (transliterationIndex, error) {
+	if o.transliterations == nil {
+		normalizer, err := o.getTitleNormalizer()
+		if err != nil {
+			return nil, err
+		}
+		index, err := buildTransliterationIndex(songs, normalizer)
+		if err != nil {
+			return nil, err
+		}
+		o.transliterations = index
+	}
+	return o.transliterations, nil
+}
+
+func (o *SearchOptions) getTitleNgramIndex(songs songSource) (*titleNgramIndex, error) {
+	if o.titleNgramIndex == nil {
+		normalizer, err := o.getTitleNormalizer()
+		if err != nil {
+			return nil, err
+		}
+		index, err := buildTitleNgramIndex(songs, normalizer)
+		if err != nil {
+			return nil, err
+		}
+		o.titleNgramIndex = index
+	}
+	return o.titleNgramIndex, nil
+}
+
+func (o *SearchOptions) getRules() ([]*rule, error) {
+	if o.rules == nil && o.Config != nil {
+		rules, err := compileRules(o.Config.Rules)
+		if err != nil {
+			return nil, err
+		}
+		o.rules = rules
+	}
+	return o.rules, nil
+}
+
+func (o *SearchOptions) getKeysoundIndex(songs songSource) (*keysoundIndex, error) {
+	if o.keysoundIndex == nil {
+		index, err := buildKeysoundIndex(songs)
+		if err != nil {
+			return nil, err
+		}
+		o.keysoundIndex = index
+	}
+	return o.keysoundIndex, nil
+}
+
+const (
+	keysoundIndexMinScore      = 0.8
+	keysoundIndexCandidateNum  = 5
+	keysoundIndexMinWavDefRate = 0.8
+)
+
+// デフォルトのオプションで探索する
 func SearchBmsDirPathFromSDDB(bmsData *gobms.BmsData, db *sqlx.DB) (result *SearchResult, _ error) {
+	return SearchBmsDirPathFromSDDBWithOptions(bmsData, db, nil)
+}
+
+// optsがnilならデフォルトのオプションで探索する
+func SearchBmsDirPathFromSDDBWithOptions(bmsData *gobms.BmsData, db *sqlx.DB, opts *SearchOptions) (result *SearchResult, _ error) {
+	return searchBmsDirPath(bmsData, nil, "", []SongLibrary{{DB: db}}, opts)
+}
+
+// SearchBmsDirPathFromSDDBWithOptionsに加えて、差分パックのreadmeのヒントも使って探索する
+func SearchSabunTargetFromSDDB(sabunInfo *SabunInfo, db *sqlx.DB, opts *SearchOptions) (result *SearchResult, _ error) {
+	if sabunInfo == nil {
+		return nil, fmt.Errorf("sabunInfo is nil")
+	}
+	return searchBmsDirPath(sabunInfo.BmsData, sabunInfo.ReadmeHints, sabunInfo.SabunDirPath, []SongLibrary{{DB: db}}, opts)
+}
+
+// 複数のライブラリの候補をまとめて探索する。いずれかのライブラリに同じハッシュの譜面があればEXIST
+// 移動先は選ばれた譜面のライブラリの楽曲フォルダで、相対パスはライブラリのルートで解決する
+func SearchBmsDirPathFromLibraries(bmsData *gobms.BmsData, libraries []SongLibrary, opts *SearchOptions) (result *SearchResult, _ error) {
+	return searchBmsDirPath(bmsData, nil, "", libraries, opts)
+}
+
+// SearchBmsDirPathFromLibrariesに加えて、差分パックのreadmeのヒントも使って探索する
+func SearchSabunTargetFromLibraries(sabunInfo *SabunInfo, libraries []SongLibrary, opts *SearchOptions) (result *SearchResult, _ error) {
+	if sabunInfo == nil {
+		return nil, fmt.Errorf("sabunInfo is nil")
+	}
+	return searchBmsDirPath(sabunInfo.BmsData, sabunInfo.ReadmeHints, sabunInfo.SabunDirPath, libraries, opts)
+}
+
+func searchBmsDirPath(bmsData *gobms.BmsData, readmeHints *ReadmeHints, sabunDirPath string, libraries []SongLibrary, opts *SearchOptions) (result *SearchResult, _ error) {
 	if bmsData == nil {
 		return nil, fmt.Errorf("bmsData is nil")
 	}
-	if db == nil {
-		return nil, fmt.Errorf("db is nil")
+	if len(libraries) == 0 {
+		return nil, fmt.Errorf("no library")
+	}
+	for _, library := range libraries {
+		if library.DB == nil {
+			return nil, fmt.Errorf("db is nil")
+		}
+	}
+	if opts == nil {
+		opts = &SearchOptions{}
 	}
 
 	result = &SearchResult{}
 
-	isBeatoraja, isLR2, err := dbIsBeatorajaOrLR2(db)
+	songs, err := opts.getSongSource(libraries)
 	if err != nil {
-		return nil, fmt.Errorf("Failed dbIsBeatorajaOrLR2: %w", err)
+		return nil, err
 	}
 
 	// 既に同じハッシュの譜面が存在するかを確認 (beatorajaはsha256、LR2はmd5)
-	var rows *sqlx.Rows
-	if isBeatoraja {
-		rows, err = retryableQuery(db, "SELECT path FROM song WHERE sha256 = $1", bmsData.Sha256)
-	} else if isLR2 {
-		rows, err = retryableQuery(db, "SELECT path FROM song WHERE hash = $1", bmsData.Md5)
+	if c, err := songs.findByHash(bmsData.Sha256, bmsData.Md5); err != nil {
+		return nil, err
+	} else if c != nil {
+		result.Sign = EXIST
+		result.TargetBmsDirPath = filepath.Dir(c.Path)
+		result.TargetLibrary = c.Library
+		return result, nil
 	}
+
+	// 手動で移動先が指定されていれば探索しない
+	if entry, targetDirPath, err := opts.Overrides.find(bmsData, songs); err != nil {
+		return nil, fmt.Errorf("Failed to find override: %w", err)
+	} else if entry != nil {
+		result.Sign = OK
+		result.TargetBmsDirPath = targetDirPath
+		result.MatchingLevel = Manual
+		result.Confidence = 1.0
+		result.DecidedBy = ManualEvidence
+		result.Override = entry
+		return result, nil
+	}
+
+	rules, err := opts.getRules()
 	if err != nil {
-		return nil, fmt.Errorf("Failed query: %w", err)
+		return nil, err
 	}
-	if rows.Next() {
-		var c Chart
-		err := rows.StructScan(&c)
-		if err != nil {
-			return nil, fmt.Errorf("Failed rows.StructScan: %w", err)
+	routing := routeByRules(rules, bmsData)
+	result.AppliedRules = routing.AppliedRules
+	if routing.TargetDirPath != "" {
+		// 書き間違えたパスは移動中に失敗するので、探索の時点でエラーにする
+		if info, err := os.Stat(routing.TargetDirPath); err != nil {
+			return nil, fmt.Errorf("Target of the rule does not exist: %w", err)
+		} else if !info.IsDir() {
+			return nil, fmt.Errorf("Target of the rule is not a directory: %s", routing.TargetDirPath)
 		}
-		result.Sign = EXIST
-		result.TargetBmsDirPath = filepath.Dir(c.Path)
+		result.Sign = OK
+		result.TargetBmsDirPath = routing.TargetDirPath
+		result.MatchingLevel = Manual
+		result.Confidence = 1.0
+		result.DecidedBy = RuleEvidence
 		return result, nil
 	}
 
-	pureTitle := gobms.RemoveSuffixChartName(bmsData.Title)
-	rows, err = retryableQuery(db, "SELECT title, genre, artist, path FROM song WHERE title LIKE $1", pureTitle+"%")
+	ctx, err := newSearchContext(bmsData, opts)
 	if err != nil {
-		return nil, fmt.Errorf("Failed query: %w", err)
+		return nil, fmt.Errorf("Failed newSearchContext: %w", err)
 	}
-	defer rows.Close()
+	ctx.routing = routing
+	selection := candidateSelection{}
 
-	var bestChart Chart
-	var bestMatchingLevel MatchingLevel
-	for rows.Next() {
-		var c Chart
-		err := rows.StructScan(&c)
+	pureTitle := ctx.normalizer.normalize(bmsData.Title)
+	if err := ctx.searchByTitle(songs, pureTitle, TitleRetrieval, "", &selection); err != nil {
+		return nil, err
+	}
+	if selection.best == nil {
+		// 別名辞書にタイトルの別表記があれば、その表記で探す
+		for _, alias := range ctx.aliases.titles.aliases(pureTitle) {
+			if err := ctx.searchByTitle(songs, ctx.normalizer.normalize(alias), TitleRetrieval, "", &selection); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if selection.best == nil && pureTitle != "" {
+		// かなとローマ字で書き分けられたタイトルを探す。索引は最初に必要になった時に作る
+		index, err := opts.getTransliterationIndex(songs)
 		if err != nil {
-			return nil, fmt.Errorf("Failed rows.StructScan: %w", err)
+			return nil, fmt.Errorf("Failed buildTransliterationIndex: %w", err)
 		}
-
-		stringsSimilarityError := func(err error) error {
-			return fmt.Errorf("Failed StringsSimilarity: %w", err)
+		for _, title := range index.search(pureTitle) {
+			if err := ctx.searchByTitle(songs, title, TransliterationRetrieval, "", &selection); err != nil {
+				return nil, err
+			}
 		}
-
-		cPureTitle := gobms.RemoveSuffixChartName(c.Title)
-		ts, err := edlib.StringsSimilarity(pureTitle, cPureTitle, edlib.Levenshtein)
+	}
+	if selection.best == nil && pureTitle != "" {
+		// 先頭の文字が異なる等で前方一致しないタイトルを、trigramの重なりで探す
+		index, err := opts.getTitleNgramIndex(songs)
 		if err != nil {
-			return nil, stringsSimilarityError(err)
+			return nil, fmt.Errorf("Failed buildTitleNgramIndex: %w", err)
 		}
-
-		as, err := edlib.StringsSimilarity(bmsData.Artist, c.Artist, edlib.Levenshtein)
-		if err != nil {
-			return nil, stringsSimilarityError(err)
+		for _, fuzzyCandidate := range index.search(pureTitle, fuzzyTitleMinScore, fuzzyTitleCandidateNum) {
+			if err := ctx.searchByTitle(songs, fuzzyCandidate.Title, FuzzyRetrieval, "", &selection); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if selection.best == nil && pureTitle != "" {
+		// DBのタイトルに独自の接尾辞等があって見つからなければ、楽曲フォルダ名で探す
+		if err := ctx.searchByFolderName(songs, pureTitle, &selection); err != nil {
+			return nil, err
+		}
+	}
+	if selection.best == nil && !readmeHints.IsEmpty() {
+		// readmeに本体の楽曲名が書かれていれば、そのタイトルで探す
+		for _, title := range readmeHints.Titles {
+			hint := ctx.normalizer.normalize(title)
+			if hint == pureTitle {
+				continue
+			}
+			if err := ctx.searchByTitle(songs, hint, ReadmeRetrieval, hint, &selection); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if selection.best == nil {
+		// ヘッダのタイトルで見つからなければ、ファイル名と親ディレクトリ名から得たタイトルで探す
+		for _, hint := range titleHints(bmsData.Path, sabunDirPath, ctx.normalizer) {
+			if hint == pureTitle {
+				continue
+			}
+			if err := ctx.searchByTitle(songs, hint, TitleHintRetrieval, hint, &selection); err != nil {
+				return nil, err
+			}
 		}
+	}
 
-		pureGenre := gobms.RemoveSuffixChartName(bmsData.Genre)
-		cPureGenre := gobms.RemoveSuffixChartName(c.Genre)
-		gs, err := edlib.StringsSimilarity(pureGenre, cPureGenre, edlib.Levenshtein)
+	if selection.best == nil && opts.KeysoundIndex && bmsData.UniqueBmsData != nil && len(bmsData.UniqueBmsData.WavDefs) > 0 {
+		// タイトルで見つからなければ、WAV定義の音源名が大きく重なる楽曲フォルダを候補にする
+		// 汎用的な音源を共有しているだけのフォルダを避けるため、WAV定義の一致率が同じなら音源配置の類似度で選ぶ
+		index, err := opts.getKeysoundIndex(songs)
 		if err != nil {
-			return nil, stringsSimilarityError(err)
-		}
-
-		var matchingLevel MatchingLevel
-		if ts == 1.0 && as == 1.0 && gs == 1.0 {
-			matchingLevel = Perfect
-		} else if ts >= 0.9 && as >= 0.9 && gs >= 0.9 {
-			matchingLevel = Almost
-		} else if ts >= 0.9 &&
-			(bmsData.Artist != "" && c.Artist != "" && (strings.HasPrefix(bmsData.Artist, c.Artist) || strings.HasPrefix(c.Artist, bmsData.Artist))) &&
-			gs >= 0.9 {
-			matchingLevel = ArtistConditional
-		} else if ts >= 0.9 && as >= 0.9 {
-			matchingLevel = GenreConditional
-		} else if ts >= 0.8 && as+gs >= 1.5 {
-			matchingLevel = Maybe
-		} else {
-			matchingLevel = Unmatch
+			return nil, fmt.Errorf("Failed buildKeysoundIndex: %w", err)
 		}
-
-		if matchingLevel >= Maybe {
-			// WAV定義の一致率を調べ、最大のものを選ぶ。100%なら確定。
-			targetBmsData, err := loadBms(c.Path)
-			if err != nil {
-				//return nil, fmt.Errorf("Failed loadBms: %w", err)
+		for _, keysoundCandidate := range index.search(bmsData.UniqueBmsData.WavDefs, keysoundIndexMinScore, keysoundIndexCandidateNum) {
+			c := candidate{Chart: keysoundCandidate.Folder.Charts[0], Source: KeysoundRetrieval}
+			if ctx.isExcluded(&c) {
 				continue
 			}
-			if bmsData.UniqueBmsData == nil || targetBmsData.UniqueBmsData == nil {
+			sim, err := ctx.compareStrings(&c)
+			if err != nil {
+				return nil, err
+			}
+			c.setStrings(sim)
+			evaluated, err := ctx.collectEvidence(&c)
+			if err != nil {
+				return nil, err
+			} else if evaluated == nil {
 				continue
-			} else {
-				wdmr := matchingWavDefs(targetBmsData.UniqueBmsData, bmsData.UniqueBmsData)
-				if result.WavDefsMatchingResult == nil {
-					result.WavDefsMatchingResult = wdmr
-				} else if wdmr.MatchingRate > result.WavDefsMatchingResult.MatchingRate {
-					result.WavDefsMatchingResult = wdmr
-					if wdmr.MatchingRate == 1.0 {
-						bestMatchingLevel = matchingLevel
-						bestChart = c
-						result.MatchedBmsData = targetBmsData
-						break
-					}
-				}
 			}
-
-			if matchingLevel > bestMatchingLevel {
-				bestMatchingLevel = matchingLevel
-				bestChart = c
-				result.MatchedBmsData = targetBmsData
+			evaluated.updateLevel()
+			if evaluated.Level < Maybe && evaluated.WavDefs.BestRate() >= keysoundIndexMinWavDefRate {
+				evaluated.Level = Maybe
+			}
+			if evaluated.Level >= Maybe {
+				selection.add(evaluated)
 			}
 		}
 	}
-	if rows.Err() != nil {
-		return nil, fmt.Errorf("rows scan error: %w", err)
+
+	if selection.best == nil {
+		result.Sign = NG
+		result.MatchingLevel = Unmatch
+		if strings.TrimSpace(bmsData.Artist) == "" {
+			result.MissingFields = append(result.MissingFields, "artist")
+		}
+		if strings.TrimSpace(ctx.normalizer.normalize(bmsData.Genre)) == "" {
+			result.MissingFields = append(result.MissingFields, "genre")
+		}
+		return result, nil
 	}
 
-	result.MatchingLevel = bestMatchingLevel
-	if bestMatchingLevel == Unmatch {
+	best := selection.best
+	if best.Confidence < opts.MinConfidence {
 		result.Sign = NG
+		result.IsBelowMinConfidence = true
+	} else if tied := selection.tiedCandidates(); len(tied) > 0 {
+		result.Sign = AMBIGUOUS
+		result.AmbiguousTargetBmsDirPaths = []string{filepath.Dir(best.Chart.Path)}
+		for _, c := range tied {
+			result.AmbiguousTargetBmsDirPaths = append(result.AmbiguousTargetBmsDirPaths, filepath.Dir(c.Chart.Path))
+		}
+	} else if rejecting := rejectingRules(rules, bmsData, filepath.Dir(best.Chart.Path)); len(rejecting) > 0 {
+		result.Sign = NG
+		result.AppliedRules = append(result.AppliedRules, rejecting...)
 	} else {
 		result.Sign = OK
-		result.TargetBmsDirPath = filepath.Dir(bestChart.Path)
+		result.TargetBmsDirPath = filepath.Dir(best.Chart.Path)
+		result.TargetLibrary = best.Chart.Library
+	}
+	result.MatchedBmsData = best.BmsData
+	result.MatchingLevel = best.Level
+	result.Confidence = best.Confidence
+	result.StringsMatchingLevel = best.StringsLevel
+	result.MissingFields = best.MissingFields
+	result.WavDefsMatchingResult = best.WavDefs
+	result.KeysoundHashMatchingResult = best.KeysoundHash
+	result.UsageProfileSimilarity = best.UsageProfileSimilarity
+	result.RetrievalSource = best.Source
+	result.DecidedBy = selection.decidedBy
+	if best.Metrics != nil {
+		result.SabunMetrics = ctx.sabunMetrics
+		result.TargetMetrics = best.Metrics
+		result.SuspiciousFields = best.MismatchedMetrics
 	}
 
 	return result, nil
 }
 
+// titleで前方一致する譜面を候補として評価する
+// titleHintが空でなければ、ヘッダのタイトルの代わりにtitleHintで見つけた候補として評価する
+func (ctx *searchContext) searchByTitle(songs songSource, title string, source RetrievalSource, titleHint string, selection *candidateSelection) error {
+	charts, err := songs.findByTitlePrefix(title)
+	if err != nil {
+		return err
+	}
+	return ctx.evaluateCharts(charts, source, titleHint, selection)
+}
+
+// パスにtitleを含む譜面を候補として評価する
+// 楽曲フォルダ名のタイトルが一致しない候補はevaluateChartsで除かれる
+func (ctx *searchContext) searchByFolderName(songs songSource, title string, selection *candidateSelection) error {
+	charts, err := songs.findByPathContaining(title)
+	if err != nil {
+		return err
+	}
+	return ctx.evaluateCharts(charts, FolderRetrieval, "", selection)
+}
+
+// 検索結果の譜面を1つずつ評価し、MatchingLevelがMaybe以上のものをselectionに加える
+func (ctx *searchContext) evaluateCharts(charts []Chart, source RetrievalSource, titleHint string, selection *candidateSelection) error {
+	// 確定した後も、同程度に一致する別の楽曲フォルダがないかは調べる
+	isConfirmed := false
+	for _, chart := range charts {
+		c := candidate{Chart: chart, Source: source, TitleHint: titleHint}
+		if isConfirmed && filepath.Dir(c.Chart.Path) == filepath.Dir(selection.best.Chart.Path) {
+			continue
+		}
+		if ctx.isExcluded(&c) {
+			continue
+		}
+
+		sim, err := ctx.compareStrings(&c)
+		if err != nil {
+			return err
+		}
+		c.setStrings(sim)
+		if c.StringsLevel < Maybe {
+			continue
+		}
+
+		// WAV定義の一致率等を調べ、MatchingLevelを調整してから最良の候補を選ぶ
+		evaluated, err := ctx.collectEvidence(&c)
+		if err != nil {
+			return err
+		} else if evaluated == nil {
+			continue
+		}
+		evaluated.updateLevel()
+		if evaluated.Level >= Maybe {
+			selection.add(evaluated)
+		}
+
+		// 確信度が高く、WAV定義も完全に一致するなら確定
+		if evaluated.Level >= Almost && evaluated.WavDefs.BestRate() == 1.0 {
+			isConfirmed = true
+		}
+	}
+	return nil
+}
+
 func dbIsBeatorajaOrLR2(db *sqlx.DB) (isBeatoraja, isLR2 bool, _ error) {
 	rows, err := retryableQuery(db, "SELECT * FROM song LIMIT 1")
 	if err != nil {
 		return false, false, fmt.Errorf("Query error: %w", err)
 	}
+	defer rows.Close()
 	cols, err := rows.Columns()
 	if err != nil {
 		return false, false, fmt.Errorf("Columns error: %w", err)
@@ -477,72 +986,167 @@ func dbIsBeatorajaOrLR2(db *sqlx.DB) (isBeatoraja, isLR2 bool, _ error) {
 	return false, false, fmt.Errorf("Neither.")
 }
 
+// Chartに読み込むカラム。subtitle/subartist、minbpm/maxbpm/lengthはsongテーブルにあれば読み込む
+func chartColumns(db *sqlx.DB) (string, error) {
+	rows, err := retryableQuery(db, "SELECT * FROM song LIMIT 1")
+	if err != nil {
+		return "", fmt.Errorf("Query error: %w", err)
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return "", fmt.Errorf("Columns error: %w", err)
+	}
+	chartCols := []string{"title", "genre", "artist", "path"}
+	for _, col := range cols {
+		switch col {
+		case "subtitle", "subartist":
+			chartCols = append(chartCols, col)
+		case "minbpm", "maxbpm", "length":
+			chartCols = append(chartCols, "IFNULL("+col+", 0) AS "+col)
+		}
+	}
+	return strings.Join(chartCols, ", "), nil
+}
+
 func removeExt(path string) string {
 	return path[:len(path)-len(filepath.Ext(path))]
 }
 
+// 追加音源ファイルの移動先に、内容の異なる同名ファイルが存在した場合の処理方法
+type ConflictPolicy int
+
+const (
+	KeepExisting        ConflictPolicy = iota // 移動せずに既存ファイルを残す
+	OverwriteWithBackup                       // 既存ファイルをバックアップしてから上書きする
+	KeepBoth                                  // ナンバリングした名前で移動し、移動した差分の#WAVを新しい名前に書き換える
+)
+
+func (p ConflictPolicy) String() string {
+	switch p {
+	case OverwriteWithBackup:
+		return "overwrite"
+	case KeepBoth:
+		return "both"
+	default:
+		return "keep"
+	}
+}
+
+func ParseConflictPolicy(s string) (ConflictPolicy, error) {
+	for _, p := range []ConflictPolicy{KeepExisting, OverwriteWithBackup, KeepBoth} {
+		if strings.ToLower(s) == p.String() {
+			return p, nil
+		}
+	}
+	return KeepExisting, fmt.Errorf("Unknown conflict policy: %s", s)
+}
+
+// ファイルごとにConflictPolicyを決める
+type ConflictResolver func(sourcePath, targetPath string) (ConflictPolicy, error)
+
 type MovedFileLog struct {
-	SourcePath   string
-	TargetPath   string // IsRemoveDir=trueなら使用しない
-	IsSkipped    bool
-	IsRemovedDir bool
+	SourcePath     string
+	TargetPath     string // IsRemoveDir=trueなら使用しない
+	IsSkipped      bool
+	IsAlreadyMoved bool // 同じディレクトリの他の差分と共に移動済み
+	IsRemovedDir   bool
+	IsCopied       bool // 他の差分も参照するため、移動せずにコピーした
+	// 移動先に同じヘッダ参照ファイルが存在したため、移動せずに元のファイルを削除した
+	IsSourceRemoved bool
+	IsConflicted    bool // 移動先に内容の異なる同名ファイルが存在した
+	ConflictPolicy  ConflictPolicy
+	BackupPath      string // ConflictPolicy=OverwriteWithBackupの場合のみ使用
+	// ConflictPolicy=KeepBothで別名にした追加音源ファイル(SourcePath)を指すように、差分(TargetPath)の#WAVを書き換えた
+	IsWavDefsRewritten bool
 }
 
 func (log MovedFileLog) String() string {
 	if log.IsRemovedDir {
 		return fmt.Sprintf("- Removed empty dir: %s", log.SourcePath)
+	} else if log.IsWavDefsRewritten {
+		return fmt.Sprintf("Rewrote #WAV to refer to the new name: %s in %s", filepath.Base(log.SourcePath), log.TargetPath)
+	} else if log.IsAlreadyMoved {
+		return fmt.Sprintf("Skipped because the file has already been moved: %s", log.SourcePath)
+	} else if log.IsSkipped && log.IsSourceRemoved {
+		return fmt.Sprintf("Removed because the same file already exist: %s = %s", log.SourcePath, log.TargetPath)
 	} else if log.IsSkipped {
 		return fmt.Sprintf("Skipped because the same file already exist: %s = %s", log.SourcePath, log.TargetPath)
+	} else if log.IsConflicted {
+		switch log.ConflictPolicy {
+		case OverwriteWithBackup:
+			if log.IsCopied {
+				return fmt.Sprintf("Overwrote a different file with a copy: %s -> %s (backup: %s)", log.SourcePath, log.TargetPath, log.BackupPath)
+			}
+			return fmt.Sprintf("Overwrote a different file: %s -> %s (backup: %s)", log.SourcePath, log.TargetPath, log.BackupPath)
+		case KeepBoth:
+			if log.IsCopied {
+				return fmt.Sprintf("Copied with a new name because a different file already exist: %s -> %s", log.SourcePath, log.TargetPath)
+			}
+			return fmt.Sprintf("Moved with a new name because a different file already exist: %s -> %s", log.SourcePath, log.TargetPath)
+		default:
+			return fmt.Sprintf("Kept the existing file because its content differs: %s != %s", log.SourcePath, log.TargetPath)
+		}
+	} else if log.IsCopied {
+		return fmt.Sprintf("Copied: %s -> %s", log.SourcePath, log.TargetPath)
 	}
 	return fmt.Sprintf("Moved: %s -> %s", log.SourcePath, log.TargetPath)
 }
 
+// 1つの差分のみを移動する。同じディレクトリの他の差分と共有する追加音源ファイルも移動するので、
+// 複数の差分をまとめて移動する場合はMakeMovePlanを使う
+// 内容の異なる同名の追加音源ファイルは常にKeepExistingで処理する
 func MoveSabunFileAndAdditionalSoundFiles(sabunDirPath string, sabunInfo *SabunInfo) ([]MovedFileLog, error) {
-	getTargetPath := func(dir, src string, duplicationNum int) string {
-		base := filepath.Base(src)
-		if duplicationNum == 0 {
-			return filepath.Join(dir, base)
-		} else {
-			ext := filepath.Ext(base)
-			name := base[:len(base)-len(ext)]
-			return filepath.Join(dir, fmt.Sprintf("%s (%d)%s", name, duplicationNum, ext))
-		}
-	}
-
-	move := func(sourcePath, targetDirPath string, isSabun bool) ([]MovedFileLog, error) {
-		moveFileLogs := []MovedFileLog{}
-		var targetPath string
-		if isSabun {
-			// ファイル名が重複したらナンバリングを追加して再試行
-			for i := 0; ; i++ {
-				targetPath = getTargetPath(targetDirPath, sourcePath, i)
-				if fileExists(targetPath) {
-					// ファイル名が同じで内容も同じファイルが存在するなら、ファイル移動処理をスキップする
-					if same, err := isSameFile(sourcePath, targetPath); err != nil {
-						return nil, fmt.Errorf("Failed isSameFile: %w", err)
-					} else if same {
-						moveFileLogs = append(moveFileLogs, MovedFileLog{SourcePath: sourcePath, TargetPath: targetPath, IsSkipped: true})
-						return moveFileLogs, nil
-					}
-				} else {
-					break
-				}
+	return MoveSabunFileAndAdditionalSoundFilesWithResolver(sabunDirPath, sabunInfo, nil)
+}
+
+// resolveConflictがnilなら、内容の異なる同名の追加音源ファイルは常にKeepExistingで処理する
+func MoveSabunFileAndAdditionalSoundFilesWithResolver(sabunDirPath string, sabunInfo *SabunInfo, resolveConflict ConflictResolver) ([]MovedFileLog, error) {
+	if sabunInfo.TargetSearchResult == nil {
+		return nil, fmt.Errorf("TargetSearchResult is nil")
+	}
+	return MakeMovePlan(sabunDirPath, []SabunInfo{*sabunInfo}).Execute(resolveConflict)
+}
+
+func getTargetPath(dir, src string, duplicationNum int) string {
+	base := filepath.Base(src)
+	if duplicationNum == 0 {
+		return filepath.Join(dir, base)
+	} else {
+		ext := filepath.Ext(base)
+		name := base[:len(base)-len(ext)]
+		return filepath.Join(dir, fmt.Sprintf("%s (%d)%s", name, duplicationNum, ext))
+	}
+}
+
+// ファイルを移動(copies=trueならコピー)する
+// allowsRenaming=trueなら同名ファイルが存在した場合にナンバリングし、falseならConflictPolicyに従う
+// removesSameSource=trueなら、移動先に同じファイルが存在した場合に元のファイルを削除する
+func transferFile(sabunDirPath, sourcePath, targetDirPath string, allowsRenaming, copies, removesSameSource bool, resolveConflict ConflictResolver) ([]MovedFileLog, error) {
+	moveFileLogs := []MovedFileLog{}
+	if !fileExists(sourcePath) {
+		moveFileLogs = append(moveFileLogs, MovedFileLog{SourcePath: sourcePath, IsAlreadyMoved: true})
+		return moveFileLogs, nil
+	}
+
+	// ファイル名が重複したらナンバリングを追加して再試行
+	// ファイル名が同じで内容も同じファイルが存在するなら、ファイル移動処理をスキップする
+	findNumberedTargetPath := func(startNum int) (targetPath string, isSame bool, _ error) {
+		for i := startNum; ; i++ {
+			targetPath = getTargetPath(targetDirPath, sourcePath, i)
+			if !fileExists(targetPath) {
+				return targetPath, false, nil
 			}
-		} else {
-			targetPath = getTargetPath(targetDirPath, sourcePath, 0)
-			// bmsファイル以外(追加音源ファイルなど)は、移動先に同名ファイルが存在したら、移動処理をスキップする
-			if fileExists(targetPath) {
-				moveFileLogs = append(moveFileLogs, MovedFileLog{SourcePath: sourcePath, TargetPath: targetPath, IsSkipped: true})
-				return moveFileLogs, nil
+			if same, err := isSameFile(sourcePath, targetPath); err != nil {
+				return "", false, fmt.Errorf("Failed isSameFile: %w", err)
+			} else if same {
+				return targetPath, true, nil
 			}
 		}
+	}
 
-		if err := moveFile(sourcePath, targetPath); err != nil {
-			return nil, fmt.Errorf("Failed to move: %w", err)
-		}
-		moveFileLogs = append(moveFileLogs, MovedFileLog{SourcePath: sourcePath, TargetPath: targetPath})
-
-		// move後のディレクトリが空(もしくは.txtファイルのみ)ならディレクトリを削除する
+	// move後のディレクトリが空(もしくは.txtファイルのみ)ならディレクトリを削除する
+	removeSourceDirectory := func() ([]MovedFileLog, error) {
 		movedDirPath := filepath.Dir(sourcePath)
 		if filepath.Clean(movedDirPath) != filepath.Clean(sabunDirPath) {
 			if removed, err := removeEmptyDirectory(movedDirPath); err != nil {
@@ -551,33 +1155,98 @@ func MoveSabunFileAndAdditionalSoundFiles(sabunDirPath string, sabunInfo *SabunI
 				moveFileLogs = append(moveFileLogs, MovedFileLog{SourcePath: movedDirPath, IsRemovedDir: true})
 			}
 		}
-
 		return moveFileLogs, nil
 	}
 
-	if sabunInfo.TargetSearchResult == nil {
-		return nil, fmt.Errorf("TargetSearchResult is nil")
-	}
+	movedLog := MovedFileLog{SourcePath: sourcePath}
 
-	moveFileLogs := []MovedFileLog{}
+	// 移動先に同じファイルがあれば移動済みとして扱い、removesSameSource=trueかつコピーでなければ元のファイルを削除する
+	skipSameFile := func(targetPath string) ([]MovedFileLog, error) {
+		skippedLog := movedLog
+		skippedLog.TargetPath = targetPath
+		skippedLog.IsSkipped = true
+		if copies || !removesSameSource {
+			return append(moveFileLogs, skippedLog), nil
+		}
+		if err := os.Remove(sourcePath); err != nil {
+			return moveFileLogs, fmt.Errorf("Failed to remove: %w", err)
+		}
+		skippedLog.IsSourceRemoved = true
+		moveFileLogs = append(moveFileLogs, skippedLog)
+		return removeSourceDirectory()
+	}
 
-	// 差分BMSファイル移動
-	if logs, err := move(sabunInfo.BmsData.Path, sabunInfo.TargetSearchResult.TargetBmsDirPath, true); err != nil {
-		return nil, err
+	var targetPath string
+	if allowsRenaming {
+		var isSame bool
+		var err error
+		targetPath, isSame, err = findNumberedTargetPath(0)
+		if err != nil {
+			return nil, err
+		} else if isSame {
+			return skipSameFile(targetPath)
+		}
 	} else {
-		moveFileLogs = append(moveFileLogs, logs...)
+		targetPath = getTargetPath(targetDirPath, sourcePath, 0)
+		// 追加音源ファイルは、移動先に内容の異なる同名ファイルが存在したら、ConflictPolicyに従って処理する
+		if fileExists(targetPath) {
+			if same, err := isSameFile(sourcePath, targetPath); err != nil {
+				return nil, fmt.Errorf("Failed isSameFile: %w", err)
+			} else if same {
+				return skipSameFile(targetPath)
+			}
+
+			policy := KeepExisting
+			if resolveConflict != nil {
+				var err error
+				if policy, err = resolveConflict(sourcePath, targetPath); err != nil {
+					return nil, fmt.Errorf("Failed to resolve conflict: %w", err)
+				}
+			}
+			movedLog.IsConflicted = true
+			movedLog.ConflictPolicy = policy
+
+			switch policy {
+			case OverwriteWithBackup:
+				backupPath := getBackupPath(targetPath)
+				if err := os.Rename(targetPath, backupPath); err != nil {
+					return nil, fmt.Errorf("Failed to back up: %w", err)
+				}
+				movedLog.BackupPath = backupPath
+			case KeepBoth:
+				// 以前にナンバリングして移動した同じファイルがあれば、それを新しい名前として使う
+				var isSame bool
+				var err error
+				targetPath, isSame, err = findNumberedTargetPath(1)
+				if err != nil {
+					return nil, err
+				} else if isSame {
+					return skipSameFile(targetPath)
+				}
+			default:
+				movedLog.TargetPath = targetPath
+				moveFileLogs = append(moveFileLogs, movedLog)
+				return moveFileLogs, nil
+			}
+		}
 	}
-	// 追加音源ファイル移動
-	// TODO 音源が直下でなくディレクトリ内にある場合、移動先にディレクトリを作る必要があるかも？
-	for _, AdditionalSoundFilePath := range sabunInfo.AdditionalSoundFilePaths {
-		if logs, err := move(AdditionalSoundFilePath, sabunInfo.TargetSearchResult.TargetBmsDirPath, false); err != nil {
-			return moveFileLogs, err
-		} else {
-			moveFileLogs = append(moveFileLogs, logs...)
+
+	movedLog.TargetPath = targetPath
+	if copies {
+		if err := copyFile(sourcePath, targetPath); err != nil {
+			return nil, fmt.Errorf("Failed to copy: %w", err)
 		}
+		movedLog.IsCopied = true
+		moveFileLogs = append(moveFileLogs, movedLog)
+		return moveFileLogs, nil
 	}
 
-	return moveFileLogs, nil
+	if err := moveFile(sourcePath, targetPath); err != nil {
+		return nil, fmt.Errorf("Failed to move: %w", err)
+	}
+	moveFileLogs = append(moveFileLogs, movedLog)
+
+	return removeSourceDirectory()
 }
 
 func isSameFile(path1, path2 string) (bool, error) {
@@ -592,6 +1261,15 @@ func isSameFile(path1, path2 string) (bool, error) {
 	return reflect.DeepEqual(bytes1, bytes2), nil
 }
 
+// 既存ファイルと重ならないバックアップファイルのパスを返す
+func getBackupPath(path string) string {
+	backupPath := path + ".bak"
+	for i := 2; fileExists(backupPath); i++ {
+		backupPath = fmt.Sprintf("%s.bak%d", path, i)
+	}
+	return backupPath
+}
+
 func fileExists(path string) bool {
 	_, err := os.Stat(path)
 	return err == nil
@@ -599,16 +1277,24 @@ func fileExists(path string) bool {
 
 // パーティションをまたぐことが可能なファイル移動
 func moveFile(sourcePath, targetPath string) error {
-	sourceBytes, err := os.ReadFile(sourcePath)
-	if err != nil {
+	if err := copyFile(sourcePath, targetPath); err != nil {
 		return err
 	}
 
-	if err := os.WriteFile(targetPath, sourceBytes, 0664); err != nil {
+	if err := os.Remove(sourcePath); err != nil {
 		return err
 	}
 
-	if err := os.Remove(sourcePath); err != nil {
+	return nil
+}
+
+func copyFile(sourcePath, targetPath string) error {
+	sourceBytes, err := os.ReadFile(sourcePath)
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(targetPath, sourceBytes, 0664); err != nil {
 		return err
 	}
 
@@ -0,0 +1,166 @@
+package applysabun
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/japanese"
+)
+
+// gobmsでは取得できないヘッダ情報を読むための簡易的なBMSスキャン結果
+// #RANDOM等の制御構文は解釈せず、全ての行を読む
+type bmsScan struct {
+	Headers map[string]string // キーは小文字のコマンド名 (例: "stagefile")
+	Objects []bmsObject       // チャンネルデータの"00"以外のオブジェクト
+}
+
+type bmsObject struct {
+	Measure  int
+	Channel  string  // 大文字の2文字 (例: "11")
+	Value    string  // 大文字の2文字 (例: "0Z")
+	Position float64 // 小節内の位置 (0以上1未満)
+}
+
+func scanBms(path string) (*bmsScan, error) {
+	text, err := readTextFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	scan := bmsScan{Headers: map[string]string{}}
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "#") {
+			continue
+		}
+		command, value := line[1:], ""
+		if i := strings.IndexAny(command, " \t"); i >= 0 {
+			command, value = command[:i], strings.TrimSpace(command[i+1:])
+		}
+		if strings.Contains(command, ":") {
+			scan.Objects = append(scan.Objects, parseChannelLine(line)...)
+			continue
+		}
+		command = strings.ToLower(command)
+		if _, ok := scan.Headers[command]; !ok {
+			scan.Headers[command] = value
+		}
+	}
+	return &scan, nil
+}
+
+// "#mmmCC:data"形式の行からオブジェクトを取り出す
+func parseChannelLine(line string) []bmsObject {
+	i := strings.Index(line, ":")
+	if i != 6 {
+		return nil
+	}
+	measure, err := strconv.Atoi(line[1:4])
+	if err != nil {
+		return nil
+	}
+	channel := strings.ToUpper(line[4:6])
+	data := strings.ToUpper(strings.TrimSpace(line[i+1:]))
+	if channel == "02" {
+		// 小節長変更はオブジェクト列ではない
+		return []bmsObject{{Measure: measure, Channel: channel, Value: data}}
+	}
+
+	objects := []bmsObject{}
+	num := len(data) / 2
+	for j := 0; j < num; j++ {
+		value := data[j*2 : j*2+2]
+		if value != "00" {
+			objects = append(objects, bmsObject{Measure: measure, Channel: channel, Value: value, Position: float64(j) / float64(num)})
+		}
+	}
+	return objects
+}
+
+// UTF-8として不正ならShift-JISとしてデコードする
+func readTextFile(path string) (string, error) {
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	bytes = []byte(strings.TrimPrefix(string(bytes), "\ufeff"))
+	if utf8.Valid(bytes) {
+		return string(bytes), nil
+	}
+	decoded, err := japanese.ShiftJIS.NewDecoder().Bytes(bytes)
+	if err != nil {
+		return "", fmt.Errorf("Failed to decode Shift-JIS: %w", err)
+	}
+	return string(decoded), nil
+}
+
+// #WAVxxのうちoldNameと拡張子を除いて一致する定義を、拡張子を残してnewNameに書き換える
+// プレイヤーは拡張子違いの音源も探すので、拡張子は比較しない。書き換えたらtrueを返す
+// 書き換えない行はバイト列をそのまま残し、書き換える行は元の文字コード(UTF-8かShift-JIS)で書き込む
+func rewriteWavDefs(path, oldName, newName string) (bool, error) {
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	isShiftJIS := !utf8.Valid(bytes)
+
+	oldPureName, newPureName := removeExt(oldName), removeExt(newName)
+	rewritten := false
+	lines := strings.SplitAfter(string(bytes), "\n")
+	for i, rawLine := range lines {
+		line := rawLine
+		if isShiftJIS {
+			decoded, err := japanese.ShiftJIS.NewDecoder().String(rawLine)
+			if err != nil {
+				continue
+			}
+			line = decoded
+		}
+		trimmed := strings.TrimLeft(strings.TrimPrefix(line, "\ufeff"), " \t")
+		if len(trimmed) < 7 || !strings.EqualFold(trimmed[:4], "#wav") || strings.IndexAny(trimmed, " \t") != 6 {
+			continue
+		}
+		value := strings.TrimSpace(trimmed[7:])
+		if !strings.EqualFold(removeExt(value), oldPureName) {
+			continue
+		}
+
+		// 定義の値だけを置き換え、行頭と改行は残す
+		valueStart := len(line) - len(trimmed) + 7 + strings.Index(trimmed[7:], value)
+		newLine := line[:valueStart] + newPureName + filepath.Ext(value) + line[valueStart+len(value):]
+		if isShiftJIS {
+			if newLine, err = japanese.ShiftJIS.NewEncoder().String(newLine); err != nil {
+				return false, fmt.Errorf("Failed to encode Shift-JIS: %w", err)
+			}
+		}
+		lines[i] = newLine
+		rewritten = true
+	}
+	if !rewritten {
+		return false, nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "")), info.Mode().Perm()); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// #WAVxxの定義。キーは大文字のインデックス(例: "01")
+func (s bmsScan) WavDefs() map[string]string {
+	wavDefs := map[string]string{}
+	for command, value := range s.Headers {
+		if len(command) == 5 && strings.HasPrefix(command, "wav") && value != "" {
+			wavDefs[strings.ToUpper(command[3:])] = value
+		}
+	}
+	return wavDefs
+}
@@ -0,0 +1,553 @@
+package applysabun
+
+import (
+	"fmt"
+	"math"
+	"path/filepath"
+	"strings"
+
+	"github.com/Shimi9999/gobms"
+	"github.com/hbollon/go-edlib"
+)
+
+// MatchingLevelや候補の選択を決めた根拠
+type DecisionEvidence string
+
+const (
+	StringsEvidence      DecisionEvidence = "strings"       // タイトル・アーティスト・ジャンルの類似度
+	WavDefsEvidence      DecisionEvidence = "wavdefs"       // WAV定義の一致による昇格・降格、または候補間の選択
+	KeysoundHashEvidence DecisionEvidence = "keysound-hash" // 音源ファイルの内容の一致による候補間の選択
+	UsageProfileEvidence DecisionEvidence = "usage-profile" // 音源配置の類似度による候補間の選択
+	ChartMetricsEvidence DecisionEvidence = "chart-metrics" // BPMと演奏時間の近さによる候補間の選択
+	ManualEvidence       DecisionEvidence = "manual"        // Overridesによる指定
+	RuleEvidence         DecisionEvidence = "rule"          // 設定のルールによる指定
+)
+
+// 探索中の候補の譜面1つ分の評価
+type candidate struct {
+	Chart                  Chart
+	Source                 RetrievalSource
+	TitleHint              string // Source=TitleHintRetrieval・ReadmeRetrievalの場合に、候補を見つけたタイトル
+	Strings                *stringsSimilarity
+	StringsConfidence      float64       // 文字列の類似度のみによる確信度
+	StringsLevel           MatchingLevel // 文字列の類似度のみによるMatchingLevel
+	MissingFields          []string      // 差分か候補で空のため、比較しなかったフィールド
+	Confidence             float64       // WAV定義等の証拠を合わせた確信度
+	Level                  MatchingLevel // WAV定義等の証拠による昇格・降格後のMatchingLevel
+	BmsData                *gobms.BmsData
+	WavDefs                *WavDefsMatchingResult
+	KeysoundHash           *KeysoundHashMatchingResult
+	UsageProfileSimilarity float64
+	HasUsageProfile        bool          // 差分と候補の両方の音源配置が得られ、UsageProfileSimilarityが有効
+	Metrics                *ChartMetrics // 差分か候補のBPM等が不明ならnil
+	MetricsSimilarity      float64
+	MismatchedMetrics      []string // 差分と一致しないBPM・演奏時間の項目
+}
+
+// 1回の探索で共通の情報
+type searchContext struct {
+	bmsData      *gobms.BmsData
+	opts         *SearchOptions
+	routing      ruleRouting
+	normalizer   *titleNormalizer
+	aliases      *aliasDictionaries
+	sabunProfile usageProfile
+	sabunMetrics *ChartMetrics
+	// gobmsでは取得できない差分のヘッダ
+	sabunSubtitle  string
+	sabunSubartist string
+}
+
+func newSearchContext(bmsData *gobms.BmsData, opts *SearchOptions) (*searchContext, error) {
+	normalizer, err := opts.getTitleNormalizer()
+	if err != nil {
+		return nil, err
+	}
+	aliases, err := opts.getAliases()
+	if err != nil {
+		return nil, err
+	}
+	ctx := searchContext{bmsData: bmsData, opts: opts, normalizer: normalizer, aliases: aliases}
+	// 候補の譜面と音源の配置を比較するため、差分の小節ごとの音源配置を求める
+	if scan, err := scanBms(bmsData.Path); err == nil {
+		ctx.sabunProfile = makeUsageProfile(scan)
+		ctx.sabunMetrics = makeChartMetrics(scan)
+		ctx.sabunSubtitle = scan.Headers["subtitle"]
+		ctx.sabunSubartist = scan.Headers["subartist"]
+	}
+	return &ctx, nil
+}
+
+// 確認者に却下された、または設定のルールで除かれる楽曲フォルダか
+func (ctx *searchContext) isExcluded(c *candidate) bool {
+	dirPath := filepath.Dir(c.Chart.Path)
+	return ctx.opts.Decisions.IsRejected(ctx.bmsData, dirPath) || ctx.routing.excludes(dirPath)
+}
+
+func (ctx *searchContext) usageProfileSimilarity(scan *bmsScan) float64 {
+	if ctx.sabunProfile == nil || scan == nil {
+		return 0
+	}
+	return usageProfileSimilarity(ctx.sabunProfile, makeUsageProfile(scan))
+}
+
+// songテーブルにBPMのカラムがあればその値を、なければ候補の譜面から求めた値を使う
+func (ctx *searchContext) compareMetrics(c *candidate, scan *bmsScan) {
+	if ctx.sabunMetrics == nil {
+		return
+	}
+	c.Metrics = makeChartMetricsFromChart(&c.Chart)
+	if c.Metrics == nil && scan != nil {
+		c.Metrics = makeChartMetrics(scan)
+	}
+	if c.Metrics == nil {
+		return
+	}
+	c.MetricsSimilarity = ctx.sabunMetrics.similarity(c.Metrics)
+	c.MismatchedMetrics = ctx.sabunMetrics.mismatchedFields(c.Metrics)
+}
+
+// 差分と候補の文字列の類似度
+// 差分か候補のどちらかで空のアーティスト・ジャンルは不明とみなし、一致とも不一致ともみなさない
+type stringsSimilarity struct {
+	Title            float64
+	Artist           float64
+	Genre            float64
+	ArtistIsKnown    bool
+	GenreIsKnown     bool
+	ArtistIsPrefixed bool // 片方のアーティストがもう片方の先頭部分 (例: "xxx" と "xxx feat. yyy")
+	// 差分と候補のサブアーティストが一致した場合のみtrue。譜面作者のクレジットの裏付けとして使う
+	// 差分のサブアーティストは差分作者であることが多いため、一致しなくても減点しない
+	SubartistIsMatched bool
+	// 候補の楽曲フォルダ名から読み取ったタイトル・アーティストとの類似度
+	// DBのタイトルに独自の接尾辞が付いている場合の、独立した裏付けとして使う
+	// フォルダ名は楽曲と無関係なこと(連番など)も多いので、タイトルが一致した場合のみKnownにする
+	FolderTitle         float64
+	FolderArtist        float64
+	FolderTitleIsKnown  bool
+	FolderArtistIsKnown bool
+}
+
+func stringsSimilarityOf(a, b string) (float64, error) {
+	s, err := edlib.StringsSimilarity(a, b, edlib.Levenshtein)
+	if err != nil {
+		return 0, fmt.Errorf("Failed StringsSimilarity: %w", err)
+	}
+	return float64(s), nil
+}
+
+// サブタイトルに難易度名を入れる譜面や、タイトルとサブタイトルを分けて登録するDBがあるので、
+// タイトル単体とサブタイトルを連結したものの組み合わせのうち、最も高い類似度を使う
+// ファイル名等から得たタイトルで見つけた候補は、そのタイトルとも比較する
+func (ctx *searchContext) titleSimilarity(c *candidate) (float64, error) {
+	titles := ctx.sabunTitles(c)
+	cTitles := []string{ctx.normalizer.normalize(c.Chart.Title), ctx.joinSubtitle(c.Chart.Title, c.Chart.Subtitle)}
+	// 別名辞書で同じタイトルとされていれば一致とする
+	for _, title := range titles {
+		for _, cTitle := range cTitles {
+			if ctx.aliases.titles.isSame(title, cTitle) {
+				return 1.0, nil
+			}
+		}
+	}
+	s, err := maxStringsSimilarity(titles, cTitles)
+	if err != nil {
+		return 0, err
+	}
+	// かなとローマ字で書き分けられたタイトルは、ローマ字にそろえた表記でも比較する
+	for _, title := range titles {
+		for _, cTitle := range cTitles {
+			if title == "" || cTitle == "" || containsKana(title) == containsKana(cTitle) {
+				continue
+			}
+			ts, err := stringsSimilarityOf(transliterationKey(title), transliterationKey(cTitle))
+			if err != nil {
+				return 0, err
+			}
+			s = math.Max(s, ts)
+		}
+	}
+	return s, nil
+}
+
+func (ctx *searchContext) joinSubtitle(title, subtitle string) string {
+	if strings.TrimSpace(subtitle) == "" {
+		return ""
+	}
+	return ctx.normalizer.normalize(title + " " + subtitle)
+}
+
+// 候補と比較する差分のタイトル
+func (ctx *searchContext) sabunTitles(c *candidate) []string {
+	titles := []string{ctx.normalizer.normalize(ctx.bmsData.Title), ctx.joinSubtitle(ctx.bmsData.Title, ctx.sabunSubtitle)}
+	if c.TitleHint != "" {
+		titles = append(titles, c.TitleHint)
+	}
+	return titles
+}
+
+// 空文字列を除いた全ての組み合わせのうち、最も高い類似度を返す
+func maxStringsSimilarity(titles, cTitles []string) (float64, error) {
+	var best float64
+	for _, title := range titles {
+		for _, cTitle := range cTitles {
+			if title == "" || cTitle == "" {
+				continue
+			}
+			s, err := stringsSimilarityOf(title, cTitle)
+			if err != nil {
+				return 0, err
+			}
+			best = math.Max(best, s)
+		}
+	}
+	return best, nil
+}
+
+// "obj:xxx"のような譜面作者の表記の揺れを取り除く
+func normalizeSubartist(subartist string) string {
+	s := strings.ToLower(strings.TrimSpace(subartist))
+	for _, prefix := range []string{"obj:", "obj.", "obj ", "譜面:", "差分:"} {
+		s = strings.TrimSpace(strings.TrimPrefix(s, prefix))
+	}
+	return s
+}
+
+func (ctx *searchContext) compareStrings(cand *candidate) (*stringsSimilarity, error) {
+	bmsData, normalizer, c := ctx.bmsData, ctx.normalizer, &cand.Chart
+	stringsSimilarityError := func(err error) error {
+		return fmt.Errorf("Failed StringsSimilarity: %w", err)
+	}
+
+	ts, err := ctx.titleSimilarity(cand)
+	if err != nil {
+		return nil, err
+	}
+
+	as, err := edlib.StringsSimilarity(bmsData.Artist, c.Artist, edlib.Levenshtein)
+	if err != nil {
+		return nil, stringsSimilarityError(err)
+	}
+	if ctx.aliases.artists.isSame(bmsData.Artist, c.Artist) {
+		as = 1.0
+	}
+
+	pureGenre := normalizer.normalize(bmsData.Genre)
+	cPureGenre := normalizer.normalize(c.Genre)
+	gs, err := edlib.StringsSimilarity(pureGenre, cPureGenre, edlib.Levenshtein)
+	if err != nil {
+		return nil, stringsSimilarityError(err)
+	}
+
+	sim := stringsSimilarity{
+		Title:         ts,
+		Artist:        float64(as),
+		Genre:         float64(gs),
+		ArtistIsKnown: strings.TrimSpace(bmsData.Artist) != "" && strings.TrimSpace(c.Artist) != "",
+		GenreIsKnown:  strings.TrimSpace(pureGenre) != "" && strings.TrimSpace(cPureGenre) != "",
+	}
+	sim.ArtistIsPrefixed = sim.ArtistIsKnown && (strings.HasPrefix(bmsData.Artist, c.Artist) || strings.HasPrefix(c.Artist, bmsData.Artist))
+
+	if subartist, cSubartist := normalizeSubartist(ctx.sabunSubartist), normalizeSubartist(c.Subartist); subartist != "" && cSubartist != "" {
+		ss, err := stringsSimilarityOf(subartist, cSubartist)
+		if err != nil {
+			return nil, err
+		}
+		sim.SubartistIsMatched = ss >= 0.9
+	}
+
+	if err := ctx.compareFolderName(cand, &sim); err != nil {
+		return nil, err
+	}
+	return &sim, nil
+}
+
+func (sim stringsSimilarity) MissingFields() []string {
+	missingFields := []string{}
+	if !sim.ArtistIsKnown {
+		missingFields = append(missingFields, "artist")
+	}
+	if !sim.GenreIsKnown {
+		missingFields = append(missingFields, "genre")
+	}
+	return missingFields
+}
+
+// DBのタイトルと楽曲フォルダ名のタイトルのうち、より一致する方の類似度
+func (sim stringsSimilarity) bestTitle() float64 {
+	if sim.FolderTitleIsKnown {
+		return math.Max(sim.Title, sim.FolderTitle)
+	}
+	return sim.Title
+}
+
+// タイトルと、判明しているアーティスト・ジャンルが全て0.9以上か。どちらも不明ならタイトルのみの一致なのでfalse
+func (sim stringsSimilarity) isHigh() bool {
+	if !sim.ArtistIsKnown && !sim.GenreIsKnown {
+		return false
+	}
+	return sim.bestTitle() >= 0.9 && (!sim.ArtistIsKnown || sim.Artist >= 0.9) && (!sim.GenreIsKnown || sim.Genre >= 0.9)
+}
+
+func (sim stringsSimilarity) isExact() bool {
+	return sim.ArtistIsKnown && sim.GenreIsKnown && sim.Title == 1.0 && sim.Artist == 1.0 && sim.Genre == 1.0
+}
+
+// 確信度に使う各シグナルの重み。得られないシグナル(不明なフィールドや無効なオプション)は除いて正規化する
+const (
+	titleWeight        = 0.4
+	artistWeight       = 0.2
+	genreWeight        = 0.1
+	wavDefsWeight      = 0.3
+	keysoundHashWeight = 0.2
+	usageProfileWeight = 0.1
+	subartistWeight    = 0.1
+	folderTitleWeight  = 0.1
+	folderArtistWeight = 0.05
+)
+
+type weightedSignals struct {
+	sum, weightSum float64
+}
+
+func (w *weightedSignals) add(value, weight float64) {
+	w.sum += value * weight
+	w.weightSum += weight
+}
+
+func (w weightedSignals) value() float64 {
+	if w.weightSum == 0 {
+		return 0
+	}
+	return w.sum / w.weightSum
+}
+
+func (sim stringsSimilarity) addSignals(w *weightedSignals) {
+	w.add(sim.Title, titleWeight)
+	if sim.ArtistIsKnown {
+		w.add(sim.Artist, artistWeight)
+	}
+	if sim.GenreIsKnown {
+		w.add(sim.Genre, genreWeight)
+	}
+	if sim.SubartistIsMatched {
+		w.add(1, subartistWeight)
+	}
+	if sim.FolderTitleIsKnown {
+		w.add(sim.FolderTitle, folderTitleWeight)
+	}
+	if sim.FolderArtistIsKnown {
+		w.add(sim.FolderArtist, folderArtistWeight)
+	}
+}
+
+// 文字列の類似度のみによる確信度 (0-1)
+func (sim stringsSimilarity) confidence() float64 {
+	w := weightedSignals{}
+	sim.addSignals(&w)
+	return w.value()
+}
+
+// 文字列の類似度とWAV定義等の証拠を合わせた確信度 (0-1)。候補の順位付けとMinConfidenceに使う
+func (c *candidate) confidence() float64 {
+	w := weightedSignals{}
+	c.Strings.addSignals(&w)
+	if c.WavDefs != nil && c.WavDefs.WavDefsNum > 0 {
+		w.add(c.WavDefs.BestRate(), wavDefsWeight)
+	}
+	if c.KeysoundHash != nil && c.KeysoundHash.WavDefsNum > 0 {
+		w.add(c.KeysoundHash.MatchingRate(), keysoundHashWeight)
+	}
+	if c.HasUsageProfile {
+		w.add(c.UsageProfileSimilarity, usageProfileWeight)
+	}
+	return w.value()
+}
+
+const (
+	// WAV定義の一致率(BestRate)がこれ以上なら、MaybeからConditionalまでをAlmostに昇格する
+	wavDefsPromotionRate = 0.95
+	// WAV定義の一致率がこれ未満なら、文字列のみで決まったAlmostからConditionalまでをMaybeに降格する
+	wavDefsDemotionRate = 0.2
+)
+
+// 文字列のみの確信度からMatchingLevelを決める
+// タイトルの類似度が低い候補はUnmatch。Perfect・Almost・Conditionalには文字列の条件もあり、互いに重ならない
+// ArtistConditionalはアーティストが前方一致のみ、GenreConditionalはアーティストが一致しジャンルが一致しないもの
+func levelFromConfidence(confidence float64, sim *stringsSimilarity) MatchingLevel {
+	if sim.bestTitle() < 0.8 {
+		return Unmatch
+	}
+	titleIsHigh := sim.bestTitle() >= 0.9
+	genreIsHigh := !sim.GenreIsKnown || sim.Genre >= 0.9
+	switch {
+	case confidence >= 0.95 && sim.isExact():
+		return Perfect
+	case confidence >= 0.8 && sim.isHigh():
+		return Almost
+	case confidence >= 0.8 && titleIsHigh && sim.ArtistIsPrefixed && sim.Artist < 0.9 && genreIsHigh:
+		return ArtistConditional
+	case confidence >= 0.8 && titleIsHigh && sim.ArtistIsKnown && sim.Artist >= 0.9 && !genreIsHigh:
+		return GenreConditional
+	case confidence >= 0.7:
+		return Maybe
+	}
+	return Unmatch
+}
+
+func (c *candidate) setStrings(sim *stringsSimilarity) {
+	c.Strings = sim
+	c.MissingFields = sim.MissingFields()
+	c.StringsConfidence = sim.confidence()
+	c.StringsLevel = levelFromConfidence(c.StringsConfidence, sim)
+}
+
+// 候補の譜面を読み込んでWAV定義等の証拠を集める。読み込めない譜面やWAV定義のない譜面はnilを返す
+func (ctx *searchContext) collectEvidence(c *candidate) (*candidate, error) {
+	targetBmsData, err := loadBms(c.Chart.Path)
+	if err != nil {
+		return nil, nil
+	}
+	if ctx.bmsData.UniqueBmsData == nil || targetBmsData.UniqueBmsData == nil {
+		return nil, nil
+	}
+	c.BmsData = targetBmsData
+	c.WavDefs = matchingWavDefs(targetBmsData.UniqueBmsData, ctx.bmsData.UniqueBmsData)
+	if ctx.opts.KeysoundHash {
+		c.KeysoundHash, err = matchingKeysoundHashes(ctx.bmsData.UniqueBmsData.WavDefs, filepath.Dir(ctx.bmsData.Path), filepath.Dir(c.Chart.Path), ctx.opts.hashCache())
+		if err != nil {
+			return nil, fmt.Errorf("Failed matchingKeysoundHashes: %w", err)
+		}
+	}
+	// 読み込めない場合は音源配置とBPM等を比較しない
+	scan, err := scanBms(c.Chart.Path)
+	if err != nil {
+		scan = nil
+	}
+	c.UsageProfileSimilarity = ctx.usageProfileSimilarity(scan)
+	c.HasUsageProfile = ctx.sabunProfile != nil && scan != nil
+	ctx.compareMetrics(c, scan)
+	return c, nil
+}
+
+// 文字列のみで決めたMatchingLevelを、WAV定義の一致率で昇格・降格する
+// 降格はMaybeまでで、Perfectは変えない。証拠を合わせた確信度は順位付けとMinConfidenceにのみ使う
+func (c *candidate) updateLevel() {
+	c.Confidence = c.confidence()
+	c.Level = c.StringsLevel
+	if c.WavDefs == nil || c.WavDefs.WavDefsNum == 0 {
+		return
+	}
+	rate := c.WavDefs.BestRate()
+	if rate >= wavDefsPromotionRate && c.Level >= Maybe && c.Level < Almost {
+		c.Level = Almost
+	} else if rate < wavDefsDemotionRate && c.Level > Maybe && c.Level <= Almost {
+		c.Level = Maybe
+	}
+}
+
+// 2つの候補を比較し、aが良ければ正、bが良ければ負の値と、差を決めた根拠を返す
+// MatchingLevel、音源ファイルの内容の一致率、WAV定義の一致率、音源配置の類似度、BPMと演奏時間の近さ、確信度の順に比較する
+func compareCandidates(a, b *candidate) (int, DecisionEvidence) {
+	compareFloat := func(x, y float64) int {
+		if x > y {
+			return 1
+		} else if x < y {
+			return -1
+		}
+		return 0
+	}
+
+	if a.Level != b.Level {
+		evidence := StringsEvidence
+		if a.Level != a.StringsLevel || b.Level != b.StringsLevel {
+			evidence = WavDefsEvidence
+		}
+		return int(a.Level) - int(b.Level), evidence
+	}
+	if a.KeysoundHash != nil && b.KeysoundHash != nil {
+		if cmp := compareFloat(a.KeysoundHash.MatchingRate(), b.KeysoundHash.MatchingRate()); cmp != 0 {
+			return cmp, KeysoundHashEvidence
+		}
+	}
+	if a.WavDefs != nil && b.WavDefs != nil {
+		if cmp := compareFloat(a.WavDefs.BestRate(), b.WavDefs.BestRate()); cmp != 0 {
+			return cmp, WavDefsEvidence
+		}
+	}
+	if cmp := compareFloat(a.UsageProfileSimilarity, b.UsageProfileSimilarity); cmp != 0 {
+		return cmp, UsageProfileEvidence
+	}
+	if a.Metrics != nil && b.Metrics != nil {
+		if cmp := compareFloat(a.MetricsSimilarity, b.MetricsSimilarity); cmp != 0 {
+			return cmp, ChartMetricsEvidence
+		}
+	}
+	if cmp := compareFloat(a.StringsConfidence, b.StringsConfidence); cmp != 0 {
+		return cmp, StringsEvidence
+	}
+	return 0, ""
+}
+
+// 2つの候補がMatchingLevelとWAV定義(と音源ファイルの内容)の一致、BPMと演奏時間で区別できないか
+func isTiedCandidates(a, b *candidate) bool {
+	if a.Level != b.Level {
+		return false
+	}
+	if a.Metrics != nil && b.Metrics != nil && len(a.MismatchedMetrics) != len(b.MismatchedMetrics) {
+		return false
+	}
+	if a.KeysoundHash != nil && b.KeysoundHash != nil && a.KeysoundHash.MatchingRate() != b.KeysoundHash.MatchingRate() {
+		return false
+	}
+	if (a.WavDefs == nil) != (b.WavDefs == nil) {
+		return false
+	}
+	return a.WavDefs == nil || a.WavDefs.BestRate() == b.WavDefs.BestRate()
+}
+
+// 最良の候補と、その決定の根拠を返す
+type candidateSelection struct {
+	best       *candidate
+	decidedBy  DecisionEvidence
+	candidates []*candidate
+}
+
+// 最良の候補と区別できない、別のディレクトリの候補を返す
+// 同じ楽曲が複数のフォルダ(オリジナル、リマスター版、イベント再配布版など)に存在する場合
+func (s *candidateSelection) tiedCandidates() []*candidate {
+	tied := []*candidate{}
+	dirPathMap := map[string]bool{filepath.Dir(s.best.Chart.Path): true}
+	for _, c := range s.candidates {
+		dirPath := filepath.Dir(c.Chart.Path)
+		if !dirPathMap[dirPath] && isTiedCandidates(c, s.best) {
+			dirPathMap[dirPath] = true
+			tied = append(tied, c)
+		}
+	}
+	return tied
+}
+
+func (s *candidateSelection) add(c *candidate) {
+	s.candidates = append(s.candidates, c)
+	if s.best == nil {
+		s.best = c
+		s.decidedBy = s.evidenceOfLevel(c)
+		return
+	}
+	cmp, evidence := compareCandidates(c, s.best)
+	if cmp > 0 {
+		s.best = c
+		s.decidedBy = evidence
+	} else if cmp < 0 && c.Level == s.best.Level && evidence != "" {
+		// 同じMatchingLevelの候補の中から選ばれた根拠を記録する
+		s.decidedBy = evidence
+	}
+}
+
+func (s *candidateSelection) evidenceOfLevel(c *candidate) DecisionEvidence {
+	if c.Level != c.StringsLevel {
+		return WavDefsEvidence
+	}
+	return StringsEvidence
+}
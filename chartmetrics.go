@@ -0,0 +1,167 @@
+package applysabun
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 譜面のBPMと演奏時間
+// 同じタイトルの別バージョン(ショート版とロング版など)の楽曲フォルダを区別するために使う
+type ChartMetrics struct {
+	InitialBpm float64 // songテーブルから取得した場合は0
+	MinBpm     float64
+	MaxBpm     float64
+	Length     float64 // 最後のキー音までの秒数。不明なら0
+}
+
+func (m ChartMetrics) String() string {
+	bpm := fmt.Sprintf("%.0f", m.MaxBpm)
+	if m.MinBpm != m.MaxBpm {
+		bpm = fmt.Sprintf("%.0f-%.0f", m.MinBpm, m.MaxBpm)
+	}
+	return fmt.Sprintf("BPM %s, %.0fs", bpm, m.Length)
+}
+
+const (
+	defaultBpm = 130.0
+	// songテーブルのBPMは整数に丸められていることがあるので、その分の差は許容する
+	bpmTolerance = 1.0
+	// 演奏時間の差は、計算方法の違い(最後のノーツかBGMか等)による誤差を許容する
+	lengthToleranceRate    = 0.05
+	lengthToleranceSeconds = 5.0
+)
+
+// BPM変更と小節長変更を反映して、譜面のBPMと演奏時間を求める
+// #STOPは演奏時間に含めない
+func makeChartMetrics(scan *bmsScan) *ChartMetrics {
+	parseBpm := func(s string) (float64, bool) {
+		bpm, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+		return bpm, err == nil && bpm > 0
+	}
+
+	initialBpm := defaultBpm
+	if bpm, ok := parseBpm(scan.Headers["bpm"]); ok {
+		initialBpm = bpm
+	}
+	m := ChartMetrics{InitialBpm: initialBpm, MinBpm: initialBpm, MaxBpm: initialBpm}
+
+	type bpmChange struct {
+		Measure  int
+		Position float64
+		Bpm      float64
+	}
+	changes := []bpmChange{}
+	measureLengths := map[int]float64{}
+	var last *bmsObject
+	for i, object := range scan.Objects {
+		switch {
+		case object.Channel == "02":
+			if length, err := strconv.ParseFloat(object.Value, 64); err == nil && length > 0 {
+				measureLengths[object.Measure] = length
+			}
+		case object.Channel == "03":
+			if bpm, err := strconv.ParseInt(object.Value, 16, 64); err == nil && bpm > 0 {
+				changes = append(changes, bpmChange{object.Measure, object.Position, float64(bpm)})
+			}
+		case object.Channel == "08":
+			if bpm, ok := parseBpm(scan.Headers["bpm"+strings.ToLower(object.Value)]); ok {
+				changes = append(changes, bpmChange{object.Measure, object.Position, bpm})
+			}
+		case isKeysoundChannel(object.Channel):
+			if last == nil || object.Measure > last.Measure || (object.Measure == last.Measure && object.Position > last.Position) {
+				last = &scan.Objects[i]
+			}
+		}
+	}
+	sort.SliceStable(changes, func(i, j int) bool {
+		if changes[i].Measure != changes[j].Measure {
+			return changes[i].Measure < changes[j].Measure
+		}
+		return changes[i].Position < changes[j].Position
+	})
+	for _, change := range changes {
+		m.MinBpm = math.Min(m.MinBpm, change.Bpm)
+		m.MaxBpm = math.Max(m.MaxBpm, change.Bpm)
+	}
+	if last == nil {
+		return &m
+	}
+
+	// 小節の先頭から順に、BPM変更ごとに区切って経過時間を足していく
+	bpm := initialBpm
+	j := 0
+	for measure := 0; measure <= last.Measure; measure++ {
+		beats := 4.0
+		if length, ok := measureLengths[measure]; ok {
+			beats *= length
+		}
+		end := 1.0
+		if measure == last.Measure {
+			end = last.Position
+		}
+		position := 0.0
+		for ; j < len(changes) && changes[j].Measure == measure && changes[j].Position <= end; j++ {
+			m.Length += (changes[j].Position - position) * beats * 60 / bpm
+			position, bpm = changes[j].Position, changes[j].Bpm
+		}
+		m.Length += (end - position) * beats * 60 / bpm
+	}
+	return &m
+}
+
+// songテーブルのBPMと演奏時間(ミリ秒)から作る。カラムがなければnil
+func makeChartMetricsFromChart(c *Chart) *ChartMetrics {
+	if c.MaxBpm <= 0 {
+		return nil
+	}
+	minBpm := c.MinBpm
+	if minBpm <= 0 {
+		minBpm = c.MaxBpm
+	}
+	return &ChartMetrics{MinBpm: minBpm, MaxBpm: c.MaxBpm, Length: float64(c.Length) / 1000}
+}
+
+// 差分と候補のBPM・演奏時間が一致しない項目を返す
+func (m *ChartMetrics) mismatchedFields(other *ChartMetrics) []string {
+	fields := []string{}
+	if math.Abs(m.MinBpm-other.MinBpm) > bpmTolerance || math.Abs(m.MaxBpm-other.MaxBpm) > bpmTolerance {
+		fields = append(fields, "bpm")
+	}
+	if m.Length > 0 && other.Length > 0 {
+		tolerance := math.Max(lengthToleranceSeconds, math.Max(m.Length, other.Length)*lengthToleranceRate)
+		if math.Abs(m.Length-other.Length) > tolerance {
+			fields = append(fields, "length")
+		}
+	}
+	return fields
+}
+
+// BPMと演奏時間の近さを0-1で返す。許容範囲内の差は1とする
+func (m *ChartMetrics) similarity(other *ChartMetrics) float64 {
+	ratio := func(x, y float64) float64 {
+		if x <= 0 || y <= 0 {
+			return 0
+		}
+		return math.Min(x, y) / math.Max(x, y)
+	}
+	mismatched := map[string]bool{}
+	for _, field := range m.mismatchedFields(other) {
+		mismatched[field] = true
+	}
+
+	bpmSimilarity := 1.0
+	if mismatched["bpm"] {
+		bpmSimilarity = (ratio(m.MinBpm, other.MinBpm) + ratio(m.MaxBpm, other.MaxBpm)) / 2
+	}
+	if m.Length <= 0 || other.Length <= 0 {
+		return bpmSimilarity
+	}
+	lengthSimilarity := 1.0
+	if mismatched["length"] {
+		lengthSimilarity = ratio(m.Length, other.Length)
+	}
+	return (bpmSimilarity + lengthSimilarity) / 2
+}
@@ -1,42 +1,125 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"os"
+	"sort"
 	"strings"
 
 	"github.com/Shimi9999/applysabun"
-	"github.com/jmoiron/sqlx"
 )
 
-var db *sqlx.DB
+var libraries []applysabun.SongLibrary
 
 func main() {
-	usageText := "Usage: applysabun songdata.db-path [sabun-dir-path]"
+	usageText := "Usage: applysabun [options] songdata.db-path... [sabun-dir-path]"
 	flag.Usage = func() {
-		fmt.Fprint(os.Stderr, usageText)
+		fmt.Fprintln(os.Stderr, usageText)
+		flag.PrintDefaults()
 	}
+	conflict := flag.String("conflict", "keep", "how to handle an additional sound file that differs from the existing one: keep, overwrite, both or ask")
+	keysoundHash := flag.Bool("hash", false, "compare the contents of keysound files between the sabun pack and candidate song folders")
+	keysoundIndex := flag.Bool("keysound-index", false, "search song folders by keysound names when no title matches (builds an index of the whole library)")
+	minConfidence := flag.Float64("min-confidence", 0, "treat matches with a confidence below this value (0-1) as NG")
+	sortsByConfidence := flag.Bool("sort-confidence", false, "print the results in ascending order of confidence")
+	configPath := flag.String("config", "", "path of the config file (JSON)")
+	overridesPath := flag.String("overrides", "", "path of the file (JSON) that specifies the target song folders of sabuns manually")
+	decisionsPath := flag.String("decisions", "", "path of the file (JSON) that records rejected targets, which are not proposed again")
+	proposesAliases := flag.Bool("propose-aliases", false, "print artist/title aliases found in the library (song folders with the same keysounds) for the config file, then exit")
+	preload := flag.Bool("preload", false, "load the song table into memory once instead of querying the DB for each sabun")
+	review := flag.Bool("review", false, "confirm each OK target and record rejected ones in the -decisions file")
 	flag.Parse()
 
-	if len(flag.Args()) == 0 || len(flag.Args()) > 2 {
+	if len(flag.Args()) == 0 {
 		fmt.Println(usageText)
 		os.Exit(1)
 	}
 
-	sddbPath := flag.Arg(0)
-	sabunDirPath := "./"
-	if len(flag.Args()) == 2 {
-		sabunDirPath = flag.Arg(1)
+	config := applysabun.DefaultConfig()
+	if *configPath != "" {
+		var err error
+		if config, err = applysabun.LoadConfig(*configPath); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
 	}
 
-	var err error
-	db, err = applysabun.OpenSongdb(sddbPath)
-	if err != nil {
-		fmt.Println("database open error: %w", err)
+	var overrides *applysabun.Overrides
+	if *overridesPath != "" {
+		var err error
+		if overrides, err = applysabun.LoadOverrides(*overridesPath); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	var decisions *applysabun.DecisionStore
+	if *decisionsPath != "" {
+		var err error
+		if decisions, err = applysabun.LoadDecisionStore(*decisionsPath); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	} else if *review {
+		fmt.Println("-review requires -decisions")
 		os.Exit(1)
 	}
-	defer db.Close()
+
+	var resolveConflict applysabun.ConflictResolver
+	if *conflict == "ask" {
+		resolveConflict = askConflictPolicy
+	} else {
+		policy, err := applysabun.ParseConflictPolicy(*conflict)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		resolveConflict = func(_, _ string) (applysabun.ConflictPolicy, error) {
+			return policy, nil
+		}
+	}
+
+	// 2つ以上の引数の最後がDBファイルでなければ差分ディレクトリとして扱う
+	sddbPaths := flag.Args()
+	sabunDirPath := "./"
+	if len(sddbPaths) >= 2 {
+		lastPath := sddbPaths[len(sddbPaths)-1]
+		if info, err := os.Stat(lastPath); err != nil || info.IsDir() {
+			sabunDirPath = lastPath
+			sddbPaths = sddbPaths[:len(sddbPaths)-1]
+		}
+	}
+
+	for _, sddbPath := range sddbPaths {
+		library, err := applysabun.OpenSongLibrary(sddbPath)
+		if err != nil {
+			fmt.Printf("database open error: %s: %s\n", sddbPath, err)
+			os.Exit(1)
+		}
+		defer library.DB.Close()
+		libraries = append(libraries, library)
+	}
+
+	if *proposesAliases {
+		if len(libraries) > 1 {
+			fmt.Println("-propose-aliases takes only one songdata.db")
+			os.Exit(1)
+		}
+		proposal, err := applysabun.ProposeAliases(libraries[0].DB, config)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		bytes, err := json.MarshalIndent(proposal, "", "  ")
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Println(string(bytes))
+		os.Exit(0)
+	}
 	// TODO:ここで探索対象のテーブルを持つDBファイルか確認するべき
 
 	sabunInfos, err := applysabun.WalkSabunDir(sabunDirPath)
@@ -45,34 +128,76 @@ func main() {
 		os.Exit(1)
 	}
 
+	searchOptions := &applysabun.SearchOptions{KeysoundHash: *keysoundHash, KeysoundIndex: *keysoundIndex, MinConfidence: *minConfidence, Config: config, Overrides: overrides, Decisions: decisions, Preload: *preload}
+	// DBが1つなら、移動先はsongテーブルのパスのまま
+	search := func(sabunInfo *applysabun.SabunInfo) (*applysabun.SearchResult, error) {
+		if len(libraries) == 1 {
+			return applysabun.SearchSabunTargetFromSDDB(sabunInfo, libraries[0].DB, searchOptions)
+		}
+		return applysabun.SearchSabunTargetFromLibraries(sabunInfo, libraries, searchOptions)
+	}
 	sabunInfoSignMap := map[applysabun.MatchingSign][]applysabun.SabunInfo{}
 	for i, sabunInfo := range sabunInfos {
 		var result *applysabun.SearchResult
 		if sabunInfo.LoadingError != nil {
 			result = &applysabun.SearchResult{Sign: applysabun.ERROR}
 		} else {
-			result, err = applysabun.SearchBmsDirPathFromSDDB(sabunInfo.BmsData, db)
+			result, err = search(&sabunInfos[i])
 			if err != nil {
 				fmt.Println(err)
 				os.Exit(1)
 			}
+			// 却下されたら、次に良い候補で探索し直す
+			for *review && result.Sign == applysabun.OK && result.MatchingLevel != applysabun.Manual {
+				fmt.Println(result.String(&sabunInfos[i]))
+				if askAccepted() {
+					break
+				}
+				decisions.Reject(sabunInfo.BmsData, result.TargetBmsDirPath)
+				if err := decisions.Save(); err != nil {
+					fmt.Println(err)
+					os.Exit(1)
+				}
+				result, err = search(&sabunInfos[i])
+				if err != nil {
+					fmt.Println(err)
+					os.Exit(1)
+				}
+			}
+		}
+		if !*sortsByConfidence {
+			fmt.Println(result.String(&sabunInfos[i]))
+		}
+		sabunInfos[i].TargetSearchResult = result
+		sabunInfoSignMap[result.Sign] = append(sabunInfoSignMap[result.Sign], sabunInfos[i])
+	}
+	if *sortsByConfidence {
+		// 確認が必要な確信度の低いものから表示する
+		sortedSabunInfos := append([]applysabun.SabunInfo{}, sabunInfos...)
+		sort.SliceStable(sortedSabunInfos, func(i, j int) bool {
+			return sortedSabunInfos[i].TargetSearchResult.Confidence < sortedSabunInfos[j].TargetSearchResult.Confidence
+		})
+		for i := range sortedSabunInfos {
+			fmt.Println(sortedSabunInfos[i].TargetSearchResult.String(&sortedSabunInfos[i]))
 		}
-		fmt.Println(result.String(&sabunInfos[i]))
-		sabunInfo.TargetSearchResult = result
-		sabunInfoSignMap[result.Sign] = append(sabunInfoSignMap[result.Sign], sabunInfo)
 	}
 
 	if len(sabunInfoSignMap) == 0 {
 		fmt.Println("BMS file not found.")
 		os.Exit(1)
 	}
-	fmt.Printf("\nOK:%d, NG:%d, EXIST:%d, ERROR:%d\n",
-		len(sabunInfoSignMap[applysabun.OK]), len(sabunInfoSignMap[applysabun.NG]), len(sabunInfoSignMap[applysabun.EXIST]), len(sabunInfoSignMap[applysabun.ERROR]))
+	fmt.Printf("\nOK:%d, NG:%d, AMBIGUOUS:%d, EXIST:%d, ERROR:%d\n",
+		len(sabunInfoSignMap[applysabun.OK]), len(sabunInfoSignMap[applysabun.NG]), len(sabunInfoSignMap[applysabun.AMBIGUOUS]),
+		len(sabunInfoSignMap[applysabun.EXIST]), len(sabunInfoSignMap[applysabun.ERROR]))
 	if len(sabunInfoSignMap[applysabun.OK]) == 0 {
 		fmt.Println("No OK sabun.")
 		os.Exit(1)
 	}
 
+	// 移動しない差分が参照する追加音源ファイルも考慮するため、全ての差分から移動計画を作る
+	movePlan := applysabun.MakeMovePlan(sabunDirPath, sabunInfos)
+	fmt.Printf("\nMove plan:\n%s", movePlan)
+
 	fmt.Printf("Move %d OK sabuns?\n", len(sabunInfoSignMap[applysabun.OK]))
 	var answer string
 	for answer != "y" && answer != "n" {
@@ -86,17 +211,47 @@ func main() {
 	}
 	fmt.Println("")
 
-	for i := range sabunInfoSignMap[applysabun.OK] {
-		if logs, err := applysabun.MoveSabunFileAndAdditionalSoundFiles(sabunDirPath, &sabunInfoSignMap[applysabun.OK][i]); err != nil {
-			fmt.Println(err)
-			os.Exit(1)
-		} else {
-			for _, log := range logs {
-				fmt.Println(log)
-			}
-		}
+	logs, err := movePlan.Execute(resolveConflict)
+	for _, log := range logs {
+		fmt.Println(log)
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
 	}
 
 	fmt.Println("\nDone")
 	os.Exit(0)
 }
+
+func askAccepted() bool {
+	var answer string
+	for answer != "y" && answer != "r" {
+		fmt.Printf("(y)es/(r)eject this target: ")
+		if _, err := fmt.Scan(&answer); err != nil {
+			return true
+		}
+		answer = strings.ToLower(answer)
+	}
+	return answer == "y"
+}
+
+func askConflictPolicy(sourcePath, targetPath string) (applysabun.ConflictPolicy, error) {
+	fmt.Printf("A different file already exists: %s != %s\n", sourcePath, targetPath)
+	var answer string
+	for answer != "k" && answer != "o" && answer != "b" {
+		fmt.Printf("(k)eep existing/(o)verwrite with backup/keep (b)oth: ")
+		if _, err := fmt.Scan(&answer); err != nil {
+			return applysabun.KeepExisting, err
+		}
+		answer = strings.ToLower(answer)
+	}
+	switch answer {
+	case "o":
+		return applysabun.OverwriteWithBackup, nil
+	case "b":
+		return applysabun.KeepBoth, nil
+	default:
+		return applysabun.KeepExisting, nil
+	}
+}
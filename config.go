@@ -0,0 +1,125 @@
+package applysabun
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/Shimi9999/gobms"
+)
+
+// 設定ファイル(JSON)の内容
+type Config struct {
+	// タイトル・ジャンルから取り除く譜面名の正規表現。gobms.RemoveSuffixChartNameの後に、一致しなくなるまで繰り返し適用する
+	// 接尾辞なら末尾、接頭辞なら先頭にアンカーした正規表現にする
+	TitlePatterns []string `json:"title_patterns"`
+	// 差分の移動先を振り分けるルール。書式はruleを参照
+	Rules []string `json:"rules"`
+	// 同じアーティスト・タイトルとみなす別名のグループ (例: [["xxx", "xxx名義"], ...])
+	ArtistAliases [][]string `json:"artist_aliases"`
+	TitleAliases  [][]string `json:"title_aliases"`
+}
+
+// 難易度・譜面名によく使われる語。英数字の語は単語境界で区切る
+const chartNameWords = `(?:\b(?:beginner|normal|hyper|another|insane|leggendaria|black\s*another|` +
+	`[57]keys?|1[04]keys?|[579]k|1[04]k|sp[bnhal]?|dp[bnhal]?|pms|obj|sabun)\b|差分|発狂|通常|地力)`
+
+// 括弧の中身が譜面名の語だけ(と末尾のOBJ表記)なら一致する正規表現
+// "(Another Mix)"のような別バージョンの表記は取り除かない
+// open・closeは括弧の文字で、正規表現の文字クラスに入れられるようにエスケープしておく
+func chartNameBracketPattern(open, close string) string {
+	delims := open + close
+	if open == close {
+		delims = open
+	}
+	credit := `\bobj\b\s*[.:：]?\s*(?:by\s+)?[^` + delims + `]+`
+	words := `(?:` + chartNameWords + `[\s._/+&・,、]*)+`
+	return `\s*[` + open + `]\s*(?i:` + words + `(?:` + credit + `)?|` + credit + `)[` + close + `]\s*$`
+}
+
+var defaultTitlePatterns = []string{
+	// -INSANE-, －ANOTHER－
+	chartNameBracketPattern(`-－`, `-－`),
+	// (差分), (7KEYS ANOTHER)
+	chartNameBracketPattern(`(（`, `)）`),
+	// [7KEYS OBJ.xxx], [SPA]
+	chartNameBracketPattern(`\[［`, `\]］`),
+	// ～LEGGENDARIA～, ~another~
+	chartNameBracketPattern(`～~〜`, `～~〜`),
+	// 【発狂】、【BMS差分】 (接尾辞と接頭辞)
+	`\s*【[^【】]*】\s*$`,
+	`^\s*【[^【】]*】\s*`,
+}
+
+func DefaultConfig() *Config {
+	return &Config{TitlePatterns: append([]string{}, defaultTitlePatterns...)}
+}
+
+// 設定ファイルにない項目はデフォルト値になる
+func LoadConfig(path string) (*Config, error) {
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("ReadFile: %w", err)
+	}
+	config := DefaultConfig()
+	if err := json.Unmarshal(bytes, config); err != nil {
+		return nil, fmt.Errorf("Failed to parse config %s: %w", path, err)
+	}
+	if _, err := config.compileTitlePatterns(); err != nil {
+		return nil, err
+	}
+	if _, err := compileRules(config.Rules); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func (c *Config) compileTitlePatterns() ([]*regexp.Regexp, error) {
+	regexps := []*regexp.Regexp{}
+	for _, pattern := range c.TitlePatterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid title pattern %s: %w", pattern, err)
+		}
+		regexps = append(regexps, re)
+	}
+	return regexps, nil
+}
+
+// gobms.RemoveSuffixChartNameに加えて、設定の正規表現で譜面名を取り除く
+type titleNormalizer struct {
+	patterns []*regexp.Regexp
+}
+
+func newTitleNormalizer(config *Config) (*titleNormalizer, error) {
+	if config == nil {
+		config = DefaultConfig()
+	}
+	patterns, err := config.compileTitlePatterns()
+	if err != nil {
+		return nil, err
+	}
+	return &titleNormalizer{patterns: patterns}, nil
+}
+
+// 全て取り除かれて空になる場合は、gobms.RemoveSuffixChartNameのみの結果を返す
+func (n *titleNormalizer) normalize(s string) string {
+	pure := gobms.RemoveSuffixChartName(s)
+	normalized := pure
+	for i := 0; i < 10; i++ {
+		prev := normalized
+		for _, re := range n.patterns {
+			normalized = re.ReplaceAllString(normalized, "")
+		}
+		if normalized == prev {
+			break
+		}
+	}
+	normalized = strings.TrimSpace(normalized)
+	if normalized == "" {
+		return pure
+	}
+	return normalized
+}
@@ -0,0 +1,81 @@
+package applysabun
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Shimi9999/gobms"
+)
+
+// 確認者が却下した(差分, 移動先)の組を記録するファイル(JSON)
+// 記録された移動先は以降の探索で候補から除くので、同じ差分ディレクトリを繰り返し処理しても同じ誤りを提案しない
+type DecisionStore struct {
+	Rejections []Rejection `json:"rejections"`
+
+	path string
+}
+
+type Rejection struct {
+	Sha256        string `json:"sha256,omitempty"`
+	Md5           string `json:"md5,omitempty"`
+	TargetDirPath string `json:"target_dir"`
+	Title         string `json:"title,omitempty"` // 確認用。照合には使わない
+}
+
+// ファイルがなければ空の記録を返す。Saveで作成される
+func LoadDecisionStore(path string) (*DecisionStore, error) {
+	store := DecisionStore{path: path}
+	bytes, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return &store, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("ReadFile: %w", err)
+	}
+	if err := json.Unmarshal(bytes, &store); err != nil {
+		return nil, fmt.Errorf("Failed to parse decisions %s: %w", path, err)
+	}
+	return &store, nil
+}
+
+func (s *DecisionStore) Save() error {
+	bytes, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Failed to marshal decisions: %w", err)
+	}
+	if err := os.WriteFile(s.path, bytes, 0644); err != nil {
+		return fmt.Errorf("WriteFile: %w", err)
+	}
+	return nil
+}
+
+func (s *DecisionStore) Reject(bmsData *gobms.BmsData, targetDirPath string) {
+	if s.IsRejected(bmsData, targetDirPath) {
+		return
+	}
+	s.Rejections = append(s.Rejections, Rejection{
+		Sha256:        bmsData.Sha256,
+		Md5:           bmsData.Md5,
+		TargetDirPath: targetDirPath,
+		Title:         bmsData.Title,
+	})
+}
+
+// sha256かmd5のどちらかが一致すれば同じ差分とみなす
+func (s *DecisionStore) IsRejected(bmsData *gobms.BmsData, targetDirPath string) bool {
+	if s == nil {
+		return false
+	}
+	for _, r := range s.Rejections {
+		isSameSabun := (r.Sha256 != "" && strings.EqualFold(r.Sha256, bmsData.Sha256)) ||
+			(r.Md5 != "" && strings.EqualFold(r.Md5, bmsData.Md5))
+		if isSameSabun && filepath.Clean(r.TargetDirPath) == filepath.Clean(targetDirPath) {
+			return true
+		}
+	}
+	return false
+}
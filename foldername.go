@@ -0,0 +1,70 @@
+package applysabun
+
+import (
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// "[artist] title"、"【artist】title"形式の楽曲フォルダ名
+var folderNameWithArtist = regexp.MustCompile(`^\s*(?:\[([^\]]+)\]|［([^］]+)］|【([^】]+)】)\s*(.+)$`)
+
+// "title (event)"のような末尾の括弧書き
+var folderNameSuffix = regexp.MustCompile(`\s*(?:\([^()]*\)|（[^（）]*）|\[[^\[\]]*\]|［[^［］]*］)\s*$`)
+
+// フォルダ名のタイトルが一致したとみなす類似度
+const folderTitleMinSimilarity = 0.8
+
+// 楽曲フォルダ名から読み取ったタイトルとアーティスト。読み取れなければ空
+type folderName struct {
+	Title  string
+	Artist string
+}
+
+func parseFolderName(name string, normalizer *titleNormalizer) folderName {
+	var f folderName
+	if match := folderNameWithArtist.FindStringSubmatch(name); match != nil {
+		f.Artist = strings.TrimSpace(match[1] + match[2] + match[3])
+		name = match[4]
+	}
+	// 括弧書きしかないフォルダ名はそのままタイトルとする
+	if title := folderNameSuffix.ReplaceAllString(name, ""); strings.TrimSpace(title) != "" {
+		name = title
+	}
+	f.Title = normalizer.normalize(strings.TrimSpace(name))
+	return f
+}
+
+func chartFolderName(path string) string {
+	return filepath.Base(filepath.Dir(path))
+}
+
+// 候補の楽曲フォルダ名を差分のタイトル・アーティストと比較する
+func (ctx *searchContext) compareFolderName(c *candidate, sim *stringsSimilarity) error {
+	f := parseFolderName(chartFolderName(c.Chart.Path), ctx.normalizer)
+	if f.Title == "" {
+		return nil
+	}
+	ts, err := maxStringsSimilarity(ctx.sabunTitles(c), []string{f.Title})
+	if err != nil {
+		return err
+	}
+	if ts < folderTitleMinSimilarity {
+		return nil
+	}
+	sim.FolderTitle = ts
+	sim.FolderTitleIsKnown = true
+
+	if f.Artist != "" && strings.TrimSpace(ctx.bmsData.Artist) != "" {
+		as, err := stringsSimilarityOf(ctx.bmsData.Artist, f.Artist)
+		if err != nil {
+			return err
+		}
+		if ctx.aliases.artists.isSame(ctx.bmsData.Artist, f.Artist) {
+			as = 1.0
+		}
+		sim.FolderArtist = as
+		sim.FolderArtistIsKnown = true
+	}
+	return nil
+}
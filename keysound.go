@@ -0,0 +1,195 @@
+package applysabun
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// 差分パックと候補の楽曲フォルダの音源ファイルを、内容のハッシュで比較した結果
+// WAV定義はBMSプレイヤーと同様に拡張子を区別せずにファイルへ解決する
+type KeysoundHashMatchingResult struct {
+	WavDefsNum   int
+	IdenticalNum int // 差分パックと楽曲フォルダの同名ファイルの内容が同じ
+	RenamedNum   int // 差分パックのファイルと同じ内容のファイルが、楽曲フォルダに別名で存在する
+	DifferingNum int // 差分パックと楽曲フォルダの同名ファイルの内容が異なる
+	SharedNum    int // 差分パックになく、楽曲フォルダのファイルを使う
+	SabunOnlyNum int // 差分パックにのみ存在する
+	MissingNum   int // どちらにも存在しない
+}
+
+// 楽曲フォルダの音源を(内容が同じものも含めて)そのまま使うWAV定義の割合
+func (r KeysoundHashMatchingResult) MatchingRate() float64 {
+	if r.WavDefsNum == 0 {
+		return 0
+	}
+	return float64(r.IdenticalNum+r.RenamedNum+r.SharedNum) / float64(r.WavDefsNum)
+}
+
+func (r KeysoundHashMatchingResult) String() string {
+	return fmt.Sprintf("identical:%d,renamed:%d,differing:%d,shared:%d,sabun-only:%d,missing:%d/%d",
+		r.IdenticalNum, r.RenamedNum, r.DifferingNum, r.SharedNum, r.SabunOnlyNum, r.MissingNum, r.WavDefsNum)
+}
+
+// 音源ファイルのハッシュとディレクトリの音源ファイル一覧のキャッシュ
+type keysoundHashCache struct {
+	hashes    map[string]string
+	soundDirs map[string]map[string][]string
+}
+
+func newKeysoundHashCache() *keysoundHashCache {
+	return &keysoundHashCache{hashes: map[string]string{}, soundDirs: map[string]map[string][]string{}}
+}
+
+func (c *keysoundHashCache) hash(path string) (string, error) {
+	if h, ok := c.hashes[path]; ok {
+		return h, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return "", err
+	}
+	h := hex.EncodeToString(hasher.Sum(nil))
+	c.hashes[path] = h
+	return h, nil
+}
+
+// ディレクトリ以下の音源ファイルを、拡張子を除いた小文字の相対パスをキーとして返す
+func (c *keysoundHashCache) soundDir(dirPath string) (map[string][]string, error) {
+	if files, ok := c.soundDirs[dirPath]; ok {
+		return files, nil
+	}
+	files := map[string][]string{}
+	err := filepath.WalkDir(dirPath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !isBmsSoundPath(path) {
+			return nil
+		}
+		rel, err := filepath.Rel(dirPath, path)
+		if err != nil {
+			return err
+		}
+		key := soundFileKey(rel)
+		files[key] = append(files[key], path)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.soundDirs[dirPath] = files
+	return files, nil
+}
+
+func soundFileKey(path string) string {
+	return strings.ToLower(removeExt(filepath.ToSlash(strings.ReplaceAll(path, "\\", "/"))))
+}
+
+// WAV定義のファイル名を解決する。定義通りの拡張子のファイルを優先し、なければ他の音源拡張子のファイルを使う
+func resolveSoundFile(files map[string][]string, wavDef string) (string, bool) {
+	paths, ok := files[soundFileKey(wavDef)]
+	if !ok {
+		return "", false
+	}
+	for _, path := range paths {
+		if strings.EqualFold(filepath.Ext(path), filepath.Ext(wavDef)) {
+			return path, true
+		}
+	}
+	return paths[0], true
+}
+
+func matchingKeysoundHashes(wavDefs map[string]string, sabunDirPath, targetDirPath string, cache *keysoundHashCache) (*KeysoundHashMatchingResult, error) {
+	sabunFiles, err := cache.soundDir(sabunDirPath)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list sound files: %w", err)
+	}
+	targetFiles, err := cache.soundDir(targetDirPath)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list sound files: %w", err)
+	}
+
+	// 別名の同一ファイル検出用。サイズが同じファイルのみハッシュを計算する
+	var targetHashesBySize map[int64]map[string]bool
+	findRenamed := func(sabunFilePath, sabunHash string) (bool, error) {
+		if targetHashesBySize == nil {
+			targetHashesBySize = map[int64]map[string]bool{}
+			for _, paths := range targetFiles {
+				for _, path := range paths {
+					info, err := os.Stat(path)
+					if err != nil {
+						return false, err
+					}
+					if targetHashesBySize[info.Size()] == nil {
+						targetHashesBySize[info.Size()] = map[string]bool{}
+					}
+					targetHashesBySize[info.Size()][path] = true
+				}
+			}
+		}
+		info, err := os.Stat(sabunFilePath)
+		if err != nil {
+			return false, err
+		}
+		for path := range targetHashesBySize[info.Size()] {
+			h, err := cache.hash(path)
+			if err != nil {
+				return false, err
+			}
+			if h == sabunHash {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	r := KeysoundHashMatchingResult{WavDefsNum: len(wavDefs)}
+	for _, wavDef := range wavDefs {
+		sabunFilePath, inSabun := resolveSoundFile(sabunFiles, wavDef)
+		targetFilePath, inTarget := resolveSoundFile(targetFiles, wavDef)
+		switch {
+		case inSabun && inTarget:
+			sh, err := cache.hash(sabunFilePath)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to hash: %w", err)
+			}
+			th, err := cache.hash(targetFilePath)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to hash: %w", err)
+			}
+			if sh == th {
+				r.IdenticalNum++
+			} else {
+				r.DifferingNum++
+			}
+		case inSabun:
+			sh, err := cache.hash(sabunFilePath)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to hash: %w", err)
+			}
+			if renamed, err := findRenamed(sabunFilePath, sh); err != nil {
+				return nil, fmt.Errorf("Failed to find renamed file: %w", err)
+			} else if renamed {
+				r.RenamedNum++
+			} else {
+				r.SabunOnlyNum++
+			}
+		case inTarget:
+			r.SharedNum++
+		default:
+			r.MissingNum++
+		}
+	}
+	return &r, nil
+}
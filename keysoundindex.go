@@ -0,0 +1,141 @@
+package applysabun
+
+import (
+	"math"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// キーとなる音源ファイル名から楽曲フォルダを引く転置インデックス
+// タイトルが全く異なる差分でも、WAV定義の重なりから元の楽曲フォルダを探せるようにする
+type keysoundIndex struct {
+	folders   []keysoundIndexFolder
+	postings  map[string][]int   // 音源名 -> foldersのインデックス
+	idfs      map[string]float64 // ありふれた音源名(kick.wav等)ほど小さい重み
+	folderNum int
+}
+
+type keysoundIndexFolder struct {
+	DirPath string
+	Charts  []Chart
+}
+
+type keysoundCandidate struct {
+	Folder *keysoundIndexFolder
+	Score  float64 // ライブラリに存在する差分の音源名のうち、フォルダにも定義されているものの重み付き割合
+}
+
+// 楽曲フォルダごとに1つの譜面のWAV定義を読み込んでインデックスを作る
+func buildKeysoundIndex(songs songSource) (*keysoundIndex, error) {
+	folders, keysoundsList, err := scanLibraryKeysounds(songs)
+	if err != nil {
+		return nil, err
+	}
+
+	index := keysoundIndex{folders: folders, postings: map[string][]int{}, idfs: map[string]float64{}}
+	for i, keysounds := range keysoundsList {
+		for _, name := range keysounds {
+			index.postings[name] = append(index.postings[name], i)
+		}
+	}
+	index.folderNum = len(index.folders)
+	for name, posting := range index.postings {
+		index.idfs[name] = math.Log(float64(index.folderNum+1) / float64(len(posting)))
+	}
+
+	return &index, nil
+}
+
+// songテーブルの譜面を楽曲フォルダごとにまとめ、フォルダごとに1つの譜面のWAV定義の音源名を返す
+// 読み込めない譜面の音源名はnil
+func scanLibraryKeysounds(songs songSource) ([]keysoundIndexFolder, [][]string, error) {
+	charts, err := songs.allCharts()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	folders := []keysoundIndexFolder{}
+	folderIndexMap := map[string]int{}
+	for _, c := range charts {
+		dirPath := filepath.Dir(c.Path)
+		i, ok := folderIndexMap[dirPath]
+		if !ok {
+			i = len(folders)
+			folderIndexMap[dirPath] = i
+			folders = append(folders, keysoundIndexFolder{DirPath: dirPath})
+		}
+		folders[i].Charts = append(folders[i].Charts, c)
+	}
+
+	keysoundsList := make([][]string, len(folders))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, 8)
+	for i := range folders {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if scan, err := scanBms(folders[i].Charts[0].Path); err == nil {
+				keysoundsList[i] = keysoundNames(scan.WavDefs())
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	return folders, keysoundsList, nil
+}
+
+// WAV定義から重複のない小文字の音源名(拡張子なし)を返す
+func keysoundNames(wavDefs map[string]string) []string {
+	nameMap := map[string]bool{}
+	for _, wavDef := range wavDefs {
+		nameMap[soundFileKey(wavDef)] = true
+	}
+	names := []string{}
+	for name := range nameMap {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// 差分のWAV定義と音源名の重なりが大きい楽曲フォルダを、スコアの高い順にlimit個まで返す
+func (index *keysoundIndex) search(wavDefs map[string]string, minScore float64, limit int) []keysoundCandidate {
+	names := keysoundNames(wavDefs)
+	var totalWeight float64
+	scores := map[int]float64{}
+	for _, name := range names {
+		// ライブラリに存在しない音源名は差分独自の音源とみなし、スコアに含めない
+		weight, ok := index.idfs[name]
+		if !ok {
+			continue
+		}
+		totalWeight += weight
+		for _, i := range index.postings[name] {
+			scores[i] += weight
+		}
+	}
+	if totalWeight == 0 {
+		return nil
+	}
+
+	candidates := []keysoundCandidate{}
+	for i, score := range scores {
+		if score/totalWeight >= minScore {
+			candidates = append(candidates, keysoundCandidate{Folder: &index.folders[i], Score: score / totalWeight})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].Score != candidates[j].Score {
+			return candidates[i].Score > candidates[j].Score
+		}
+		return strings.Compare(candidates[i].Folder.DirPath, candidates[j].Folder.DirPath) < 0
+	})
+	if len(candidates) > limit {
+		candidates = candidates[:limit]
+	}
+	return candidates
+}
@@ -0,0 +1,169 @@
+package applysabun
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// 差分ディレクトリ内のファイルの移動計画
+// 同じディレクトリの複数の差分が参照する追加音源ファイル等は共有リソースとして扱い、
+// 参照する全ての移動先にコピーしてから、最後の移動先に移動する
+type MovePlan struct {
+	SabunDirPath string
+	Sabuns       []*SabunInfo    // 移動する差分 (TargetSearchResult.SignがOKのもの)
+	PackFiles    []*PackFileMove // 追加音源ファイルとヘッダ参照ファイル
+}
+
+type PackFileMove struct {
+	SourcePath     string
+	IsAsset        bool     // ヘッダ参照ファイルならtrue、追加音源ファイルならfalse
+	TargetDirPaths []string // 重複なし。最後以外の移動先にはコピーする
+	ConsumerPaths  []string // このファイルを参照する全ての差分のパス
+	IsKeptInPack   bool     // 移動しない差分も参照しているため、全ての移動先にコピーして元のファイルを残す
+}
+
+func (m PackFileMove) IsShared() bool {
+	return len(m.ConsumerPaths) > 1
+}
+
+// sabunInfosには移動しない差分も含めて渡す。移動しない差分が参照するファイルは移動せずにコピーする
+func MakeMovePlan(sabunDirPath string, sabunInfos []SabunInfo) *MovePlan {
+	plan := MovePlan{SabunDirPath: sabunDirPath}
+	packFileMap := map[string]*PackFileMove{}
+
+	addPackFile := func(sourcePath string, isAsset bool, sabunInfo *SabunInfo, isMoved bool) {
+		m, ok := packFileMap[sourcePath]
+		if !ok {
+			m = &PackFileMove{SourcePath: sourcePath, IsAsset: isAsset}
+			packFileMap[sourcePath] = m
+			plan.PackFiles = append(plan.PackFiles, m)
+		}
+		m.ConsumerPaths = append(m.ConsumerPaths, sabunInfo.BmsData.Path)
+		if !isMoved {
+			m.IsKeptInPack = true
+			return
+		}
+		targetDirPath := sabunInfo.TargetSearchResult.TargetBmsDirPath
+		for _, dirPath := range m.TargetDirPaths {
+			if filepath.Clean(dirPath) == filepath.Clean(targetDirPath) {
+				return
+			}
+		}
+		m.TargetDirPaths = append(m.TargetDirPaths, targetDirPath)
+	}
+
+	for i := range sabunInfos {
+		sabunInfo := &sabunInfos[i]
+		isMoved := sabunInfo.TargetSearchResult != nil && sabunInfo.TargetSearchResult.Sign == OK
+		if isMoved {
+			plan.Sabuns = append(plan.Sabuns, sabunInfo)
+		}
+		for _, path := range sabunInfo.AdditionalSoundFilePaths {
+			addPackFile(path, false, sabunInfo, isMoved)
+		}
+		for _, path := range sabunInfo.AssetFilePaths {
+			addPackFile(path, true, sabunInfo, isMoved)
+		}
+	}
+
+	return &plan
+}
+
+func (p MovePlan) String() string {
+	var b strings.Builder
+	for _, sabunInfo := range p.Sabuns {
+		fmt.Fprintf(&b, "%s -> %s", sabunInfo.BmsData.Path, sabunInfo.TargetSearchResult.TargetBmsDirPath)
+		if library := sabunInfo.TargetSearchResult.TargetLibrary; library != "" {
+			fmt.Fprintf(&b, " (Library: %s)", library)
+		}
+		b.WriteString("\n")
+	}
+	for _, m := range p.PackFiles {
+		if len(m.TargetDirPaths) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "  + %s -> %s", m.SourcePath, strings.Join(m.TargetDirPaths, ", "))
+		if m.IsShared() {
+			fmt.Fprintf(&b, " (shared by %d sabuns", len(m.ConsumerPaths))
+			if m.IsKeptInPack {
+				b.WriteString(", kept in pack")
+			}
+			b.WriteString(")")
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// resolveConflictがnilなら、内容の異なる同名の追加音源ファイルは常にKeepExistingで処理する
+func (p MovePlan) Execute(resolveConflict ConflictResolver) ([]MovedFileLog, error) {
+	moveFileLogs := []MovedFileLog{}
+
+	// 差分BMSファイル移動
+	// 移動先での差分のパスは、KeepBothで別名にした追加音源ファイルを#WAVで指すために覚えておく
+	movedSabunPaths := map[string]string{}
+	for _, sabunInfo := range p.Sabuns {
+		if logs, err := transferFile(p.SabunDirPath, sabunInfo.BmsData.Path, sabunInfo.TargetSearchResult.TargetBmsDirPath, true, false, false, resolveConflict); err != nil {
+			return moveFileLogs, err
+		} else {
+			for _, log := range logs {
+				if log.SourcePath == sabunInfo.BmsData.Path && !log.IsAlreadyMoved && log.TargetPath != "" {
+					movedSabunPaths[log.SourcePath] = log.TargetPath
+				}
+			}
+			moveFileLogs = append(moveFileLogs, logs...)
+		}
+	}
+
+	// 追加音源ファイル、ヘッダ参照ファイル移動
+	// 楽曲フォルダ側のstagefile等は上書きせず、内容が同じなら差分パックから削除し、異なる場合は差分パックに残す
+	// 別名で移動しても差分からは参照されないため
+	// TODO 音源が直下でなくディレクトリ内にある場合、移動先にディレクトリを作る必要があるかも？
+	keepExisting := func(_, _ string) (ConflictPolicy, error) {
+		return KeepExisting, nil
+	}
+	for _, m := range p.PackFiles {
+		for i, targetDirPath := range m.TargetDirPaths {
+			copies := m.IsKeptInPack || i < len(m.TargetDirPaths)-1
+			resolve := resolveConflict
+			if m.IsAsset {
+				resolve = keepExisting
+			}
+			if logs, err := transferFile(p.SabunDirPath, m.SourcePath, targetDirPath, false, copies, m.IsAsset, resolve); err != nil {
+				return moveFileLogs, err
+			} else {
+				moveFileLogs = append(moveFileLogs, logs...)
+				for _, log := range logs {
+					if log.IsConflicted && log.ConflictPolicy == KeepBoth {
+						rewrittenLogs, err := m.rewriteConsumerWavDefs(log.TargetPath, movedSabunPaths)
+						moveFileLogs = append(moveFileLogs, rewrittenLogs...)
+						if err != nil {
+							return moveFileLogs, err
+						}
+					}
+				}
+			}
+		}
+	}
+
+	return moveFileLogs, nil
+}
+
+// renamedPathと同じディレクトリに移動した差分の#WAVを、別名にした追加音源ファイルを指すように書き換える
+// 移動しない差分や他の移動先の差分は、元の名前のファイルを参照するので書き換えない
+func (m PackFileMove) rewriteConsumerWavDefs(renamedPath string, movedSabunPaths map[string]string) ([]MovedFileLog, error) {
+	logs := []MovedFileLog{}
+	for _, consumerPath := range m.ConsumerPaths {
+		movedPath, ok := movedSabunPaths[consumerPath]
+		if !ok || filepath.Clean(filepath.Dir(movedPath)) != filepath.Clean(filepath.Dir(renamedPath)) {
+			continue
+		}
+		if rewritten, err := rewriteWavDefs(movedPath, filepath.Base(m.SourcePath), filepath.Base(renamedPath)); err != nil {
+			return logs, fmt.Errorf("Failed to rewrite #WAV of %s: %w", movedPath, err)
+		} else if rewritten {
+			logs = append(logs, MovedFileLog{SourcePath: renamedPath, TargetPath: movedPath, IsWavDefsRewritten: true})
+		}
+	}
+	return logs, nil
+}
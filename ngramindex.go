@@ -0,0 +1,110 @@
+package applysabun
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// DBのタイトルの文字trigramの転置インデックス
+// 前方一致のLIKEでは、先頭の文字が異なるタイトル(記号の有無や表記揺れ)を見つけられない
+type titleNgramIndex struct {
+	titles   []string
+	gramNums []int
+	postings map[string][]int // trigram -> titlesのインデックス
+}
+
+type fuzzyTitleCandidate struct {
+	Title string
+	Score float64 // trigramの集合のDice係数 (0-1)
+}
+
+const (
+	fuzzyTitleMinScore     = 0.5
+	fuzzyTitleCandidateNum = 10
+)
+
+func buildTitleNgramIndex(songs songSource, normalizer *titleNormalizer) (*titleNgramIndex, error) {
+	titles, err := songs.titles()
+	if err != nil {
+		return nil, err
+	}
+
+	index := titleNgramIndex{postings: map[string][]int{}}
+	for _, title := range titles {
+		grams := titleNgrams(normalizer.normalize(title))
+		if len(grams) == 0 {
+			continue
+		}
+		i := len(index.titles)
+		index.titles = append(index.titles, title)
+		index.gramNums = append(index.gramNums, len(grams))
+		for _, gram := range grams {
+			index.postings[gram] = append(index.postings[gram], i)
+		}
+	}
+	return &index, nil
+}
+
+// 小文字にし、空白と記号を除いた文字列の重複のないtrigram。3文字未満なら文字列全体を1つのgramとする
+func titleNgrams(title string) []string {
+	runes := []rune{}
+	for _, r := range strings.ToLower(title) {
+		if !unicode.IsSpace(r) && !unicode.IsPunct(r) && !unicode.IsSymbol(r) {
+			runes = append(runes, r)
+		}
+	}
+	if len(runes) == 0 {
+		return nil
+	}
+	if len(runes) < 3 {
+		return []string{string(runes)}
+	}
+	gramMap := map[string]bool{}
+	grams := []string{}
+	for i := 0; i+3 <= len(runes); i++ {
+		gram := string(runes[i : i+3])
+		if !gramMap[gram] {
+			gramMap[gram] = true
+			grams = append(grams, gram)
+		}
+	}
+	return grams
+}
+
+// trigramの重なりが大きいDBのタイトルを、スコアの高い順にlimit個まで返す
+func (index *titleNgramIndex) search(title string, minScore float64, limit int) []fuzzyTitleCandidate {
+	grams := titleNgrams(title)
+	if len(grams) == 0 {
+		return nil
+	}
+	sharedNums := map[int]int{}
+	for _, gram := range grams {
+		for _, i := range index.postings[gram] {
+			sharedNums[i]++
+		}
+	}
+
+	candidates := []fuzzyTitleCandidate{}
+	for i, sharedNum := range sharedNums {
+		score := 2 * float64(sharedNum) / float64(len(grams)+index.gramNums[i])
+		if score >= minScore {
+			candidates = append(candidates, fuzzyTitleCandidate{Title: index.titles[i], Score: score})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].Score != candidates[j].Score {
+			return candidates[i].Score > candidates[j].Score
+		}
+		return candidates[i].Title < candidates[j].Title
+	})
+	if len(candidates) > limit {
+		candidates = candidates[:limit]
+	}
+	return candidates
+}
+
+// LIKEのワイルドカードをエスケープする。クエリには ESCAPE '\' を付ける
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
@@ -0,0 +1,126 @@
+package applysabun
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/Shimi9999/gobms"
+)
+
+// 差分の移動先を手動で指定するファイル(JSON)の内容
+// 同じイベントの差分パックを処理する人同士で共有できるように、移動先は楽曲フォルダ内の譜面のハッシュでも指定できる
+type Overrides struct {
+	Entries []OverrideEntry `json:"overrides"`
+}
+
+// 差分はsha256・md5・タイトルの正規表現のうち、指定されたもの全てに一致すれば対象になる
+// 移動先はTargetDirPath、またはsongdata.dbから引くTargetSha256・TargetMd5の譜面のフォルダ
+type OverrideEntry struct {
+	Sha256        string `json:"sha256,omitempty"`
+	Md5           string `json:"md5,omitempty"`
+	TitlePattern  string `json:"title_pattern,omitempty"`
+	TargetDirPath string `json:"target_dir,omitempty"`
+	TargetSha256  string `json:"target_sha256,omitempty"`
+	TargetMd5     string `json:"target_md5,omitempty"`
+	Comment       string `json:"comment,omitempty"`
+
+	titleRegexp *regexp.Regexp
+}
+
+func LoadOverrides(path string) (*Overrides, error) {
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("ReadFile: %w", err)
+	}
+	overrides := Overrides{}
+	if err := json.Unmarshal(bytes, &overrides); err != nil {
+		return nil, fmt.Errorf("Failed to parse overrides %s: %w", path, err)
+	}
+	for i := range overrides.Entries {
+		if err := overrides.Entries[i].compile(); err != nil {
+			return nil, fmt.Errorf("Invalid override #%d in %s: %w", i+1, path, err)
+		}
+	}
+	return &overrides, nil
+}
+
+func (e *OverrideEntry) compile() error {
+	if e.Sha256 == "" && e.Md5 == "" && e.TitlePattern == "" {
+		return fmt.Errorf("no sha256, md5 or title_pattern")
+	}
+	if e.TargetDirPath == "" && e.TargetSha256 == "" && e.TargetMd5 == "" {
+		return fmt.Errorf("no target_dir, target_sha256 or target_md5")
+	}
+	if e.TitlePattern != "" {
+		re, err := regexp.Compile(e.TitlePattern)
+		if err != nil {
+			return fmt.Errorf("Invalid title pattern %s: %w", e.TitlePattern, err)
+		}
+		e.titleRegexp = re
+	}
+	return nil
+}
+
+func (e *OverrideEntry) matches(bmsData *gobms.BmsData) bool {
+	if e.Sha256 != "" && !strings.EqualFold(e.Sha256, bmsData.Sha256) {
+		return false
+	}
+	if e.Md5 != "" && !strings.EqualFold(e.Md5, bmsData.Md5) {
+		return false
+	}
+	if e.TitlePattern != "" {
+		if e.titleRegexp == nil {
+			if err := e.compile(); err != nil {
+				return false
+			}
+		}
+		if !e.titleRegexp.MatchString(bmsData.Title) {
+			return false
+		}
+	}
+	return true
+}
+
+// 移動先の楽曲フォルダを返す。ハッシュで指定された譜面がsongdata.dbになければ空文字列
+// LR2のDBにはsha256がないので、TargetMd5でしか引けない
+// 共有された指定のTargetDirPathがこの環境にないと移動中に失敗するので、探索の時点でエラーにする
+func (e *OverrideEntry) targetDirPath(songs songSource) (string, error) {
+	if e.TargetDirPath != "" {
+		if info, err := os.Stat(e.TargetDirPath); err != nil {
+			return "", fmt.Errorf("target_dir of the override does not exist: %w", err)
+		} else if !info.IsDir() {
+			return "", fmt.Errorf("target_dir of the override is not a directory: %s", e.TargetDirPath)
+		}
+		return e.TargetDirPath, nil
+	}
+	c, err := songs.findByHash(e.TargetSha256, e.TargetMd5)
+	if err != nil || c == nil {
+		return "", err
+	}
+	return filepath.Dir(c.Path), nil
+}
+
+// 差分に一致する最初の指定と、その移動先を返す。なければnil
+func (o *Overrides) find(bmsData *gobms.BmsData, songs songSource) (*OverrideEntry, string, error) {
+	if o == nil {
+		return nil, "", nil
+	}
+	for i := range o.Entries {
+		entry := &o.Entries[i]
+		if !entry.matches(bmsData) {
+			continue
+		}
+		targetDirPath, err := entry.targetDirPath(songs)
+		if err != nil {
+			return nil, "", err
+		}
+		if targetDirPath != "" {
+			return entry, targetDirPath, nil
+		}
+	}
+	return nil, "", nil
+}
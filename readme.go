@@ -0,0 +1,104 @@
+package applysabun
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// 差分パックのreadme等のテキストファイルから読み取ったヒント
+// 多くのreadmeには、どの楽曲の差分か、本体のダウンロードURL、譜面作者が書かれている
+type ReadmeHints struct {
+	FilePaths []string // 読み込んだテキストファイル
+	Titles    []string // 本体の楽曲名として書かれているもの
+	URLs      []string
+	Authors   []string // 譜面作者として書かれているもの
+}
+
+func (h *ReadmeHints) IsEmpty() bool {
+	return h == nil || (len(h.Titles) == 0 && len(h.URLs) == 0 && len(h.Authors) == 0)
+}
+
+func (h *ReadmeHints) String() string {
+	strs := []string{}
+	if len(h.Titles) > 0 {
+		strs = append(strs, "title="+strings.Join(h.Titles, ","))
+	}
+	if len(h.URLs) > 0 {
+		strs = append(strs, "url="+strings.Join(h.URLs, ","))
+	}
+	if len(h.Authors) > 0 {
+		strs = append(strs, "author="+strings.Join(h.Authors, ","))
+	}
+	return strings.Join(strs, " ")
+}
+
+// これより大きいテキストファイルはreadmeとみなさない
+const readmeMaxFileSize = 64 * 1024
+
+var (
+	readmeURL = regexp.MustCompile(`https?://[^\s"'<>「」()（）]+`)
+	// "本体: xxx"、"曲名：xxx"のような行
+	readmeTitleLabel = regexp.MustCompile(`(?i)^\s*[\[【<]?(?:本体|曲名|楽曲名?|原曲|対象曲?|title|song)[\]】>]?\s*[:：]\s*(.+)$`)
+	// "「xxx」の差分です"のような行。"この譜面は…"のような文を拾わないように、括弧か引用符で囲まれたものだけ
+	readmeTitleSentence = regexp.MustCompile(`(?:「([^」]+)」|『([^』]+)』|"([^"]+)")\s*の(?:差分|追加譜面|譜面)`)
+	readmeAuthorLabel   = regexp.MustCompile(`(?i)^\s*[\[【<]?(?:譜面作者|差分作者|譜面|obj|author|chart)[\]】>]?\s*[:：.]\s*(.+)$`)
+)
+
+// ディレクトリ内の.txtファイルからヒントを読み取る。読めないファイルは無視する
+func readReadmeHints(filePaths []string) *ReadmeHints {
+	hints := ReadmeHints{}
+	for _, path := range filePaths {
+		if strings.ToLower(filepath.Ext(path)) != ".txt" {
+			continue
+		}
+		if info, err := os.Stat(path); err != nil || info.Size() > readmeMaxFileSize {
+			continue
+		}
+		text, err := readTextFile(path)
+		if err != nil {
+			continue
+		}
+		hints.FilePaths = append(hints.FilePaths, path)
+		hints.parse(text)
+	}
+	if hints.IsEmpty() {
+		return nil
+	}
+	return &hints
+}
+
+func (h *ReadmeHints) parse(text string) {
+	appendUnique := func(values []string, value string) []string {
+		value = strings.Trim(strings.TrimSpace(value), `「」『』"`)
+		if value == "" || utf8.RuneCountInString(value) > 100 {
+			return values
+		}
+		for _, v := range values {
+			if v == value {
+				return values
+			}
+		}
+		return append(values, value)
+	}
+
+	for _, line := range strings.Split(text, "\n") {
+		for _, url := range readmeURL.FindAllString(line, -1) {
+			h.URLs = appendUnique(h.URLs, url)
+		}
+		// URLだけの行はタイトルとみなさない
+		line = strings.TrimSpace(readmeURL.ReplaceAllString(line, ""))
+		if line == "" {
+			continue
+		}
+		if match := readmeTitleLabel.FindStringSubmatch(line); match != nil {
+			h.Titles = appendUnique(h.Titles, match[1])
+		} else if match := readmeAuthorLabel.FindStringSubmatch(line); match != nil {
+			h.Authors = appendUnique(h.Authors, match[1])
+		} else if match := readmeTitleSentence.FindStringSubmatch(line); match != nil {
+			h.Titles = appendUnique(h.Titles, match[1]+match[2]+match[3])
+		}
+	}
+}
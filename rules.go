@@ -0,0 +1,316 @@
+package applysabun
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/Shimi9999/gobms"
+)
+
+// 設定ファイルのrulesに書く、差分の移動先を振り分けるルール
+//
+//	条件 [and 条件]... => 動作 [and 動作]...
+//
+// 条件は「フィールド 演算子 値」。フィールドはtitle, artist, genre, path(差分のパス), target(探索結果の移動先)
+// 演算子はmatches /正規表現/, starts with "文字列", contains "文字列", is "文字列"。文字列の比較は大文字小文字を区別しない
+// 動作は探索前に評価する restrict to "パス", exclude "パス", target "パス" と、探索後に評価する ng
+// restrict toとexcludeのパスは楽曲フォルダのパスの一部(ディレクトリ単位)に一致すればよい
+// targetのパスはそのまま移動先になるので、存在する楽曲フォルダのパスを省略せずに書く
+//
+// 例: genre matches /^BOF2013/ and title starts with "X" => restrict to "events/BOF2013"
+//
+//	target contains "remaster" => ng
+type rule struct {
+	Source     string
+	Conditions []ruleCondition
+	Actions    []ruleAction
+}
+
+type ruleCondition struct {
+	Field    string
+	Operator string // "matches", "starts with", "contains", "is"
+	Value    string
+	Regexp   *regexp.Regexp
+}
+
+type ruleAction struct {
+	Kind string // "restrict", "exclude", "target", "ng"
+	Path string
+}
+
+var ruleFields = map[string]bool{"title": true, "artist": true, "genre": true, "path": true, "target": true}
+
+func compileRules(sources []string) ([]*rule, error) {
+	rules := []*rule{}
+	for _, source := range sources {
+		r, err := parseRule(source)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid rule %s: %w", source, err)
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+func parseRule(source string) (*rule, error) {
+	tokens, err := tokenizeRule(source)
+	if err != nil {
+		return nil, err
+	}
+	r := rule{Source: source}
+	i := 0
+	next := func() string {
+		if i >= len(tokens) {
+			return ""
+		}
+		i++
+		return tokens[i-1]
+	}
+	// 文字列と正規表現のトークンは先頭の記号で区別する
+	value := func(prefix byte) (string, error) {
+		token := next()
+		if len(token) == 0 || token[0] != prefix {
+			return "", fmt.Errorf("expected %c...%c but got %q", prefix, prefix, token)
+		}
+		return token[1:], nil
+	}
+
+	for {
+		c := ruleCondition{Field: strings.ToLower(next())}
+		if !ruleFields[c.Field] {
+			return nil, fmt.Errorf("unknown field %q", c.Field)
+		}
+		switch operator := strings.ToLower(next()); operator {
+		case "matches":
+			pattern, err := value('/')
+			if err != nil {
+				return nil, err
+			}
+			if c.Regexp, err = regexp.Compile(pattern); err != nil {
+				return nil, err
+			}
+			c.Operator, c.Value = operator, pattern
+		case "starts":
+			if strings.ToLower(next()) != "with" {
+				return nil, fmt.Errorf("expected \"with\" after \"starts\"")
+			}
+			operator = "starts with"
+			fallthrough
+		case "contains", "is":
+			s, err := value('"')
+			if err != nil {
+				return nil, err
+			}
+			c.Operator, c.Value = operator, s
+		default:
+			return nil, fmt.Errorf("unknown operator %q", operator)
+		}
+		r.Conditions = append(r.Conditions, c)
+
+		if token := next(); token == "=>" {
+			break
+		} else if strings.ToLower(token) != "and" {
+			return nil, fmt.Errorf("expected \"and\" or \"=>\" but got %q", token)
+		}
+	}
+
+	for {
+		a := ruleAction{Kind: strings.ToLower(next())}
+		switch a.Kind {
+		case "restrict":
+			if strings.ToLower(next()) != "to" {
+				return nil, fmt.Errorf("expected \"to\" after \"restrict\"")
+			}
+			fallthrough
+		case "exclude", "target":
+			if a.Path, err = value('"'); err != nil {
+				return nil, err
+			}
+		case "ng":
+		default:
+			return nil, fmt.Errorf("unknown action %q", a.Kind)
+		}
+		r.Actions = append(r.Actions, a)
+
+		if token := next(); token == "" {
+			break
+		} else if strings.ToLower(token) != "and" {
+			return nil, fmt.Errorf("expected \"and\" but got %q", token)
+		}
+	}
+
+	// 移動先を条件にするルールは探索後にしか評価できない
+	if r.isAfterSearch() {
+		for _, a := range r.Actions {
+			if a.Kind != "ng" {
+				return nil, fmt.Errorf("only \"ng\" can be used with the target field")
+			}
+		}
+	}
+	return &r, nil
+}
+
+// 単語、"文字列"、/正規表現/、=>に分ける。文字列と正規表現はバックスラッシュで区切り文字をエスケープできる
+// 文字列と正規表現のトークンは、区切り文字の開始記号を先頭に残して返す
+func tokenizeRule(source string) ([]string, error) {
+	tokens := []string{}
+	runes := []rune(source)
+	for i := 0; i < len(runes); {
+		switch r := runes[i]; {
+		case r == ' ' || r == '\t':
+			i++
+		case r == '"' || r == '/':
+			var b strings.Builder
+			b.WriteRune(r)
+			j := i + 1
+			for ; j < len(runes) && runes[j] != r; j++ {
+				if runes[j] == '\\' && j+1 < len(runes) && runes[j+1] == r {
+					j++
+				} else if runes[j] == '\\' && r == '/' && j+1 < len(runes) {
+					// 正規表現のエスケープはそのまま残す
+					b.WriteRune(runes[j])
+					j++
+				}
+				b.WriteRune(runes[j])
+			}
+			if j >= len(runes) {
+				return nil, fmt.Errorf("unterminated %c", r)
+			}
+			tokens = append(tokens, b.String())
+			i = j + 1
+		default:
+			j := i
+			for j < len(runes) && runes[j] != ' ' && runes[j] != '\t' && runes[j] != '"' && runes[j] != '/' {
+				j++
+			}
+			tokens = append(tokens, string(runes[i:j]))
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+func (r *rule) isAfterSearch() bool {
+	for _, c := range r.Conditions {
+		if c.Field == "target" {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *rule) hasAction(kind string) bool {
+	for _, a := range r.Actions {
+		if a.Kind == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *ruleCondition) matches(value string) bool {
+	switch c.Operator {
+	case "matches":
+		return c.Regexp.MatchString(value)
+	case "starts with":
+		return strings.HasPrefix(strings.ToLower(value), strings.ToLower(c.Value))
+	case "contains":
+		return strings.Contains(strings.ToLower(value), strings.ToLower(c.Value))
+	default:
+		return strings.EqualFold(value, c.Value)
+	}
+}
+
+func (r *rule) matches(bmsData *gobms.BmsData, targetDirPath string) bool {
+	for _, c := range r.Conditions {
+		var value string
+		switch c.Field {
+		case "title":
+			value = bmsData.Title
+		case "artist":
+			value = bmsData.Artist
+		case "genre":
+			value = bmsData.Genre
+		case "path":
+			value = filepath.ToSlash(bmsData.Path)
+		case "target":
+			value = filepath.ToSlash(targetDirPath)
+		}
+		if !c.matches(value) {
+			return false
+		}
+	}
+	return true
+}
+
+// 探索前のルールを評価した結果
+type ruleRouting struct {
+	Restrictions  []string
+	Exclusions    []string
+	TargetDirPath string
+	AppliedRules  []string
+}
+
+func routeByRules(rules []*rule, bmsData *gobms.BmsData) ruleRouting {
+	routing := ruleRouting{}
+	for _, r := range rules {
+		if r.isAfterSearch() || !r.matches(bmsData, "") {
+			continue
+		}
+		// ngのみのルールは探索後に記録する
+		if len(r.Actions) > 1 || !r.hasAction("ng") {
+			routing.AppliedRules = append(routing.AppliedRules, r.Source)
+		}
+		for _, a := range r.Actions {
+			switch a.Kind {
+			case "restrict":
+				routing.Restrictions = append(routing.Restrictions, a.Path)
+			case "exclude":
+				routing.Exclusions = append(routing.Exclusions, a.Path)
+			case "target":
+				if routing.TargetDirPath == "" {
+					routing.TargetDirPath = a.Path
+				}
+			}
+		}
+	}
+	return routing
+}
+
+// 楽曲フォルダがルールで除かれるか。restrictがあれば、いずれかのパスの下にあるものだけを残す
+func (routing *ruleRouting) excludes(dirPath string) bool {
+	for _, path := range routing.Exclusions {
+		if pathIsUnder(dirPath, path) {
+			return true
+		}
+	}
+	if len(routing.Restrictions) == 0 {
+		return false
+	}
+	for _, path := range routing.Restrictions {
+		if pathIsUnder(dirPath, path) {
+			return false
+		}
+	}
+	return true
+}
+
+// 探索結果をNGにするルールを返す
+func rejectingRules(rules []*rule, bmsData *gobms.BmsData, targetDirPath string) []string {
+	sources := []string{}
+	for _, r := range rules {
+		if r.hasAction("ng") && r.matches(bmsData, targetDirPath) {
+			sources = append(sources, r.Source)
+		}
+	}
+	return sources
+}
+
+// dirPathがpathのディレクトリ、またはその下にあるか。pathはdirPathの途中のディレクトリから始まってもよい
+func pathIsUnder(dirPath, path string) bool {
+	dir := "/" + strings.Trim(strings.ToLower(filepath.ToSlash(strings.ReplaceAll(dirPath, "\\", "/"))), "/") + "/"
+	p := "/" + strings.Trim(strings.ToLower(filepath.ToSlash(strings.ReplaceAll(path, "\\", "/"))), "/") + "/"
+	return strings.Contains(dir, p)
+}
@@ -0,0 +1,135 @@
+package applysabun
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTokenizeRule(t *testing.T) {
+	tests := []struct {
+		source  string
+		want    []string
+		wantErr bool
+	}{
+		{
+			source: `title is "a b" => ng`,
+			want:   []string{"title", "is", `"a b`, "=>", "ng"},
+		},
+		{
+			source: "artist  contains\t\"x\"",
+			want:   []string{"artist", "contains", `"x`},
+		},
+		{
+			source: `title is "say \"hi\""`,
+			want:   []string{"title", "is", `"say "hi"`},
+		},
+		{
+			source: `path matches /a\/b\d+/`,
+			want:   []string{"path", "matches", `/a/b\d+`},
+		},
+		{
+			source: `genre is "C:\songs"`,
+			want:   []string{"genre", "is", `"C:\songs`},
+		},
+		{
+			source: `title is"x"and`,
+			want:   []string{"title", "is", `"x`, "and"},
+		},
+		{
+			source:  `title is "abc`,
+			wantErr: true,
+		},
+		{
+			source:  `title matches /abc`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		got, err := tokenizeRule(tt.source)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("tokenizeRule(%q) error = %v, wantErr %v", tt.source, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("tokenizeRule(%q) = %q, want %q", tt.source, got, tt.want)
+		}
+	}
+}
+
+func TestParseRule(t *testing.T) {
+	tests := []struct {
+		source         string
+		wantConditions []ruleCondition // Regexpは比較しない
+		wantActions    []ruleAction
+		wantErr        bool
+	}{
+		{
+			source: `genre matches /^BOF2013/ and title starts with "X" => restrict to "events/BOF2013"`,
+			wantConditions: []ruleCondition{
+				{Field: "genre", Operator: "matches", Value: "^BOF2013"},
+				{Field: "title", Operator: "starts with", Value: "X"},
+			},
+			wantActions: []ruleAction{{Kind: "restrict", Path: "events/BOF2013"}},
+		},
+		{
+			source:         `target contains "remaster" => ng`,
+			wantConditions: []ruleCondition{{Field: "target", Operator: "contains", Value: "remaster"}},
+			wantActions:    []ruleAction{{Kind: "ng"}},
+		},
+		{
+			source: `Artist IS "a" and path contains "x" and genre is "g" => exclude "old" and exclude "tmp" and ng`,
+			wantConditions: []ruleCondition{
+				{Field: "artist", Operator: "is", Value: "a"},
+				{Field: "path", Operator: "contains", Value: "x"},
+				{Field: "genre", Operator: "is", Value: "g"},
+			},
+			wantActions: []ruleAction{{Kind: "exclude", Path: "old"}, {Kind: "exclude", Path: "tmp"}, {Kind: "ng"}},
+		},
+		{
+			source:         `title is "a \"b\"" => target "songs/a"`,
+			wantConditions: []ruleCondition{{Field: "title", Operator: "is", Value: `a "b"`}},
+			wantActions:    []ruleAction{{Kind: "target", Path: "songs/a"}},
+		},
+		{source: `subtitle is "a" => ng`, wantErr: true},                        // 未知のフィールド
+		{source: `title equals "a" => ng`, wantErr: true},                       // 未知の演算子
+		{source: `title starts "a" => ng`, wantErr: true},                       // withがない
+		{source: `title is a => ng`, wantErr: true},                             // 文字列でない値
+		{source: `title matches "a" => ng`, wantErr: true},                      // 正規表現でない値
+		{source: `title matches /(/ => ng`, wantErr: true},                      // 不正な正規表現
+		{source: `title is "a"`, wantErr: true},                                 // =>がない
+		{source: `title is "a" or artist is "b" => ng`, wantErr: true},          // andでない
+		{source: `title is "a" =>`, wantErr: true},                              // 動作がない
+		{source: `title is "a" => delete`, wantErr: true},                       // 未知の動作
+		{source: `title is "a" => restrict "x"`, wantErr: true},                 // toがない
+		{source: `title is "a" => ng ng`, wantErr: true},                        // andでない
+		{source: `target is "a" => exclude "x"`, wantErr: true},                 // targetの条件にng以外
+		{source: `title is "a" and target is "b" => target "x"`, wantErr: true}, // targetの条件にng以外
+	}
+	for _, tt := range tests {
+		got, err := parseRule(tt.source)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseRule(%q) error = %v, wantErr %v", tt.source, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		if got.Source != tt.source {
+			t.Errorf("parseRule(%q).Source = %q", tt.source, got.Source)
+		}
+		conditions := []ruleCondition{}
+		for _, c := range got.Conditions {
+			if (c.Operator == "matches") != (c.Regexp != nil) {
+				t.Errorf("parseRule(%q): Regexp of %+v", tt.source, c)
+			}
+			c.Regexp = nil
+			conditions = append(conditions, c)
+		}
+		if !reflect.DeepEqual(conditions, tt.wantConditions) {
+			t.Errorf("parseRule(%q).Conditions = %+v, want %+v", tt.source, conditions, tt.wantConditions)
+		}
+		if !reflect.DeepEqual(got.Actions, tt.wantActions) {
+			t.Errorf("parseRule(%q).Actions = %+v, want %+v", tt.source, got.Actions, tt.wantActions)
+		}
+	}
+}
@@ -0,0 +1,471 @@
+package applysabun
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// 探索で使うsongテーブルの読み出し
+// 毎回SQLiteに問い合わせるsqlSongSourceと、一度メモリに読み込むmemorySongSourceがある
+// 複数のライブラリはmultiSongSourceでまとめる
+type songSource interface {
+	// falseならLR2のDB
+	isBeatoraja() bool
+	// 読み込んだ後にDBファイルが更新されたか。読み込み直す必要がなければfalse
+	isStale() bool
+	// beatorajaはsha256を優先し、なければmd5で探す。LR2はmd5(hashカラム)のみ。見つからなければnil
+	findByHash(sha256, md5 string) (*Chart, error)
+	// タイトルが前方一致する譜面。大文字小文字は区別しない
+	findByTitlePrefix(title string) ([]Chart, error)
+	// パスにsを含む譜面。大文字小文字は区別しない
+	findByPathContaining(s string) ([]Chart, error)
+	allCharts() ([]Chart, error)
+	// 重複のないタイトル
+	titles() ([]string, error)
+}
+
+// songテーブルのカラム名の集合
+func songColumns(db *sqlx.DB) (map[string]bool, error) {
+	rows, err := retryableQuery(db, "SELECT * FROM song LIMIT 1")
+	if err != nil {
+		return nil, fmt.Errorf("Query error: %w", err)
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, fmt.Errorf("Columns error: %w", err)
+	}
+	colMap := map[string]bool{}
+	for _, col := range cols {
+		colMap[col] = true
+	}
+	return colMap, nil
+}
+
+type sqlSongSource struct {
+	db        *sqlx.DB
+	beatoraja bool
+	chartCols string
+}
+
+func newSQLSongSource(db *sqlx.DB) (*sqlSongSource, error) {
+	isBeatoraja, _, err := dbIsBeatorajaOrLR2(db)
+	if err != nil {
+		return nil, fmt.Errorf("Failed dbIsBeatorajaOrLR2: %w", err)
+	}
+	chartCols, err := chartColumns(db)
+	if err != nil {
+		return nil, err
+	}
+	return &sqlSongSource{db: db, beatoraja: isBeatoraja, chartCols: chartCols}, nil
+}
+
+func (s *sqlSongSource) isBeatoraja() bool {
+	return s.beatoraja
+}
+
+func (s *sqlSongSource) isStale() bool {
+	return false
+}
+
+func (s *sqlSongSource) queryCharts(query string, args ...interface{}) ([]Chart, error) {
+	rows, err := retryableQuery(s.db, "SELECT "+s.chartCols+" FROM song"+query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("Failed query: %w", err)
+	}
+	defer rows.Close()
+	charts := []Chart{}
+	for rows.Next() {
+		var c Chart
+		if err := rows.StructScan(&c); err != nil {
+			return nil, fmt.Errorf("Failed rows.StructScan: %w", err)
+		}
+		charts = append(charts, c)
+	}
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("rows scan error: %w", rows.Err())
+	}
+	return charts, nil
+}
+
+func (s *sqlSongSource) findByHash(sha256, md5 string) (*Chart, error) {
+	var charts []Chart
+	var err error
+	switch {
+	case s.beatoraja && sha256 != "":
+		charts, err = s.queryCharts(" WHERE sha256 = $1 LIMIT 1", strings.ToLower(sha256))
+	case s.beatoraja && md5 != "":
+		charts, err = s.queryCharts(" WHERE md5 = $1 LIMIT 1", strings.ToLower(md5))
+	case !s.beatoraja && md5 != "":
+		charts, err = s.queryCharts(" WHERE hash = $1 LIMIT 1", strings.ToLower(md5))
+	}
+	if err != nil || len(charts) == 0 {
+		return nil, err
+	}
+	return &charts[0], nil
+}
+
+func (s *sqlSongSource) findByTitlePrefix(title string) ([]Chart, error) {
+	return s.queryCharts(" WHERE title LIKE $1 ESCAPE '\\'", escapeLike(title)+"%")
+}
+
+func (s *sqlSongSource) findByPathContaining(str string) ([]Chart, error) {
+	return s.queryCharts(" WHERE path LIKE $1 ESCAPE '\\'", "%"+escapeLike(str)+"%")
+}
+
+func (s *sqlSongSource) allCharts() ([]Chart, error) {
+	return s.queryCharts("")
+}
+
+func (s *sqlSongSource) titles() ([]string, error) {
+	rows, err := retryableQuery(s.db, "SELECT DISTINCT title FROM song")
+	if err != nil {
+		return nil, fmt.Errorf("Failed query: %w", err)
+	}
+	defer rows.Close()
+	titles := []string{}
+	for rows.Next() {
+		var title string
+		if err := rows.Scan(&title); err != nil {
+			return nil, fmt.Errorf("Failed rows.Scan: %w", err)
+		}
+		titles = append(titles, title)
+	}
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("rows scan error: %w", rows.Err())
+	}
+	return titles, nil
+}
+
+// songテーブルの必要なカラムを一度だけ読み込んだもの
+// 10万譜面規模のDBでも差分ごとの問い合わせが不要になり、起動中のプレイヤーとの競合も避けられる
+type memorySongSource struct {
+	beatoraja bool
+	charts    []Chart
+	bySha256  map[string]int
+	byMd5     map[string]int
+	// 前方一致の探索用に、ASCIIのみ小文字にしたタイトルでソートしたchartsのインデックス
+	titleOrder  []int
+	lowerTitles []string
+	// DBファイルの変更の検出用。メモリ上のDBなら空
+	filePath string
+	modTime  time.Time
+	size     int64
+}
+
+type songRow struct {
+	Chart
+	Sha256 string `db:"sha256"`
+	Md5    string `db:"md5"`
+}
+
+func loadMemorySongSource(db *sqlx.DB) (*memorySongSource, error) {
+	source := memorySongSource{bySha256: map[string]int{}, byMd5: map[string]int{}}
+
+	// 読み込み中に更新されても、次の探索で読み直すように先に記録する
+	if err := db.Get(&source.filePath, "SELECT file FROM pragma_database_list WHERE name = 'main'"); err != nil {
+		return nil, fmt.Errorf("Failed to get DB file path: %w", err)
+	}
+	if source.filePath != "" {
+		info, err := os.Stat(source.filePath)
+		if err != nil {
+			return nil, fmt.Errorf("Stat: %w", err)
+		}
+		source.modTime, source.size = info.ModTime(), info.Size()
+	}
+
+	isBeatoraja, _, err := dbIsBeatorajaOrLR2(db)
+	if err != nil {
+		return nil, fmt.Errorf("Failed dbIsBeatorajaOrLR2: %w", err)
+	}
+	source.beatoraja = isBeatoraja
+	cols, err := songColumns(db)
+	if err != nil {
+		return nil, err
+	}
+	chartCols, err := chartColumns(db)
+	if err != nil {
+		return nil, err
+	}
+	hashCols := ""
+	if isBeatoraja {
+		hashCols = ", IFNULL(sha256, '') AS sha256"
+		if cols["md5"] {
+			hashCols += ", IFNULL(md5, '') AS md5"
+		}
+	} else {
+		hashCols = ", IFNULL(hash, '') AS md5"
+	}
+
+	rows, err := retryableQuery(db, "SELECT "+chartCols+hashCols+" FROM song")
+	if err != nil {
+		return nil, fmt.Errorf("Failed query: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var row songRow
+		if err := rows.StructScan(&row); err != nil {
+			return nil, fmt.Errorf("Failed rows.StructScan: %w", err)
+		}
+		i := len(source.charts)
+		source.charts = append(source.charts, row.Chart)
+		if _, ok := source.bySha256[row.Sha256]; row.Sha256 != "" && !ok {
+			source.bySha256[row.Sha256] = i
+		}
+		if _, ok := source.byMd5[row.Md5]; row.Md5 != "" && !ok {
+			source.byMd5[row.Md5] = i
+		}
+	}
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("rows scan error: %w", rows.Err())
+	}
+
+	source.titleOrder = make([]int, len(source.charts))
+	source.lowerTitles = make([]string, len(source.charts))
+	for i := range source.charts {
+		source.titleOrder[i] = i
+		source.lowerTitles[i] = asciiToLower(source.charts[i].Title)
+	}
+	sort.SliceStable(source.titleOrder, func(i, j int) bool {
+		return source.lowerTitles[source.titleOrder[i]] < source.lowerTitles[source.titleOrder[j]]
+	})
+	return &source, nil
+}
+
+func (s *memorySongSource) isStale() bool {
+	if s.filePath == "" {
+		return false
+	}
+	info, err := os.Stat(s.filePath)
+	return err != nil || !info.ModTime().Equal(s.modTime) || info.Size() != s.size
+}
+
+func (s *memorySongSource) isBeatoraja() bool {
+	return s.beatoraja
+}
+
+func (s *memorySongSource) findByHash(sha256, md5 string) (*Chart, error) {
+	i, ok := -1, false
+	switch {
+	case s.beatoraja && sha256 != "":
+		i, ok = s.bySha256[strings.ToLower(sha256)]
+	case md5 != "":
+		i, ok = s.byMd5[strings.ToLower(md5)]
+	}
+	if !ok {
+		return nil, nil
+	}
+	c := s.charts[i]
+	return &c, nil
+}
+
+// SQLiteのLIKEと同じく、ASCIIの英字のみを小文字にする
+// strings.ToLowerでは全角英字等も変わり、SQLiteのソースと候補が変わってしまう
+func asciiToLower(s string) string {
+	bytes := []byte(s)
+	for i, b := range bytes {
+		if 'A' <= b && b <= 'Z' {
+			bytes[i] = b + ('a' - 'A')
+		}
+	}
+	return string(bytes)
+}
+
+// SQLiteで問い合わせた場合と同じく、songテーブルの行の順に返す
+func (s *memorySongSource) chartsOf(indices []int) []Chart {
+	sort.Ints(indices)
+	charts := make([]Chart, len(indices))
+	for i, index := range indices {
+		charts[i] = s.charts[index]
+	}
+	return charts
+}
+
+func (s *memorySongSource) findByTitlePrefix(title string) ([]Chart, error) {
+	prefix := asciiToLower(title)
+	start := sort.Search(len(s.titleOrder), func(i int) bool {
+		return s.lowerTitles[s.titleOrder[i]] >= prefix
+	})
+	indices := []int{}
+	for i := start; i < len(s.titleOrder) && strings.HasPrefix(s.lowerTitles[s.titleOrder[i]], prefix); i++ {
+		indices = append(indices, s.titleOrder[i])
+	}
+	return s.chartsOf(indices), nil
+}
+
+func (s *memorySongSource) findByPathContaining(str string) ([]Chart, error) {
+	lower := asciiToLower(str)
+	indices := []int{}
+	for i := range s.charts {
+		if strings.Contains(asciiToLower(s.charts[i].Path), lower) {
+			indices = append(indices, i)
+		}
+	}
+	return s.chartsOf(indices), nil
+}
+
+func (s *memorySongSource) allCharts() ([]Chart, error) {
+	return append([]Chart{}, s.charts...), nil
+}
+
+func (s *memorySongSource) titles() ([]string, error) {
+	titleMap := map[string]bool{}
+	titles := []string{}
+	for _, c := range s.charts {
+		if !titleMap[c.Title] {
+			titleMap[c.Title] = true
+			titles = append(titles, c.Title)
+		}
+	}
+	return titles, nil
+}
+
+// 探索対象の楽曲ライブラリ。複数のインストール(BMS用とPMS用のbeatoraja、LR2等)をまとめて探索できる
+type SongLibrary struct {
+	// songdata.db(LR2ではsong.db)のパス。相対パスで記録された譜面は、ライブラリのルートからのパスとして解決する
+	Path string
+	DB   *sqlx.DB
+}
+
+func OpenSongLibrary(path string) (SongLibrary, error) {
+	db, err := OpenSongdb(path)
+	if err != nil {
+		return SongLibrary{}, err
+	}
+	return SongLibrary{Path: path, DB: db}, nil
+}
+
+// 譜面の相対パスの基準となるディレクトリ
+// beatorajaはsongdata.dbのあるディレクトリ、LR2はLR2files/Databaseの上のディレクトリ
+func libraryRootDir(dbPath string, isBeatoraja bool) string {
+	dir := filepath.Dir(dbPath)
+	if !isBeatoraja && strings.EqualFold(filepath.Base(dir), "Database") && strings.EqualFold(filepath.Base(filepath.Dir(dir)), "LR2files") {
+		return filepath.Dir(filepath.Dir(dir))
+	}
+	return dir
+}
+
+type librarySongSource struct {
+	path    string
+	rootDir string
+	source  songSource
+}
+
+// 複数のライブラリのsongテーブルをまとめたもの
+// 返す譜面のPathはライブラリのルートで解決し、Libraryにライブラリのパスを入れる
+type multiSongSource struct {
+	libraries []librarySongSource
+}
+
+func newMultiSongSource(libraries []SongLibrary, sources []songSource) *multiSongSource {
+	s := multiSongSource{}
+	for i, library := range libraries {
+		s.libraries = append(s.libraries, librarySongSource{
+			path:    library.Path,
+			rootDir: libraryRootDir(library.Path, sources[i].isBeatoraja()),
+			source:  sources[i],
+		})
+	}
+	return &s
+}
+
+func (l *librarySongSource) resolve(c *Chart) {
+	c.Library = l.path
+	if !filepath.IsAbs(c.Path) {
+		c.Path = filepath.Join(l.rootDir, c.Path)
+	}
+}
+
+// いずれかのライブラリがbeatorajaならtrue
+func (s *multiSongSource) isBeatoraja() bool {
+	for _, l := range s.libraries {
+		if l.source.isBeatoraja() {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *multiSongSource) isStale() bool {
+	for _, l := range s.libraries {
+		if l.source.isStale() {
+			return true
+		}
+	}
+	return false
+}
+
+// 指定した順に各ライブラリで探し、最初に見つかった譜面を返す
+func (s *multiSongSource) findByHash(sha256, md5 string) (*Chart, error) {
+	for i := range s.libraries {
+		l := &s.libraries[i]
+		c, err := l.source.findByHash(sha256, md5)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to search %s: %w", l.path, err)
+		}
+		if c != nil {
+			l.resolve(c)
+			return c, nil
+		}
+	}
+	return nil, nil
+}
+
+// 各ライブラリの結果をライブラリの順に連結する
+func (s *multiSongSource) collect(find func(songSource) ([]Chart, error)) ([]Chart, error) {
+	charts := []Chart{}
+	for i := range s.libraries {
+		l := &s.libraries[i]
+		libraryCharts, err := find(l.source)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to search %s: %w", l.path, err)
+		}
+		for j := range libraryCharts {
+			l.resolve(&libraryCharts[j])
+		}
+		charts = append(charts, libraryCharts...)
+	}
+	return charts, nil
+}
+
+func (s *multiSongSource) findByTitlePrefix(title string) ([]Chart, error) {
+	return s.collect(func(source songSource) ([]Chart, error) {
+		return source.findByTitlePrefix(title)
+	})
+}
+
+func (s *multiSongSource) findByPathContaining(str string) ([]Chart, error) {
+	return s.collect(func(source songSource) ([]Chart, error) {
+		return source.findByPathContaining(str)
+	})
+}
+
+func (s *multiSongSource) allCharts() ([]Chart, error) {
+	return s.collect(func(source songSource) ([]Chart, error) {
+		return source.allCharts()
+	})
+}
+
+func (s *multiSongSource) titles() ([]string, error) {
+	titleMap := map[string]bool{}
+	titles := []string{}
+	for _, l := range s.libraries {
+		libraryTitles, err := l.source.titles()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to search %s: %w", l.path, err)
+		}
+		for _, title := range libraryTitles {
+			if !titleMap[title] {
+				titleMap[title] = true
+				titles = append(titles, title)
+			}
+		}
+	}
+	return titles, nil
+}
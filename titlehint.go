@@ -0,0 +1,61 @@
+package applysabun
+
+import (
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// ファイル名の末尾に付けられる難易度の語 (例: "7another", "spa", "14k_h", "insane")
+var hintDifficultyToken = regexp.MustCompile(`(?i)^(?:` + chartNameWords +
+	`|(?:\d{1,2}(?:k|keys?)?)?(?:[bnhalx]|ex|beg|nor|hyp|ano|ins|leg|easy|hard|extra|beginner|normal|hyper|another|insane|leggendaria)` +
+	`|\d{1,2}(?:k|keys?))$`)
+
+// ファイル名の区切り文字以外の並び
+var hintToken = regexp.MustCompile(`[^_\-\s.]+`)
+
+// 親ディレクトリを何階層までタイトルの候補にするか
+const titleHintDirDepth = 2
+
+// 差分のファイル名と親ディレクトリ名から、タイトルの候補を返す
+// 差分は"songname_7another.bme"のようなファイル名で、曲名のフォルダに入っていることが多い
+// 親ディレクトリはsabunDirPathより下のものだけを使う。"Downloads"等をタイトルにしないため。空ならファイル名のみ
+func titleHints(bmsPath, sabunDirPath string, normalizer *titleNormalizer) []string {
+	names := []string{removeExt(filepath.Base(bmsPath))}
+	dirPath := filepath.Dir(bmsPath)
+	for i := 0; i < titleHintDirDepth && sabunDirPath != ""; i++ {
+		rel, err := filepath.Rel(sabunDirPath, dirPath)
+		if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			break
+		}
+		names = append(names, filepath.Base(dirPath))
+		dirPath = filepath.Dir(dirPath)
+	}
+
+	hints := []string{}
+	hintMap := map[string]bool{}
+	for _, name := range names {
+		hint := removeDifficultyTokens(normalizer.normalize(name))
+		key := strings.ToLower(hint)
+		if utf8.RuneCountInString(hint) < 2 || hintMap[key] {
+			continue
+		}
+		hintMap[key] = true
+		hints = append(hints, hint)
+	}
+	return hints
+}
+
+// 末尾から難易度の語を取り除く。難易度の語しかなければ空文字列を返す
+func removeDifficultyTokens(name string) string {
+	tokens := hintToken.FindAllStringIndex(name, -1)
+	end := len(name)
+	for i := len(tokens) - 1; i >= 0; i-- {
+		if !hintDifficultyToken.MatchString(name[tokens[i][0]:tokens[i][1]]) {
+			break
+		}
+		end = tokens[i][0]
+	}
+	return strings.Trim(strings.TrimSpace(name[:end]), "_-. ")
+}
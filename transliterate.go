@@ -0,0 +1,179 @@
+package applysabun
+
+import (
+	"strings"
+	"unicode"
+)
+
+// ひらがなのヘボン式ローマ字。拗音は2文字で引く
+var kanaRomaji = map[string]string{
+	"あ": "a", "い": "i", "う": "u", "え": "e", "お": "o",
+	"か": "ka", "き": "ki", "く": "ku", "け": "ke", "こ": "ko",
+	"さ": "sa", "し": "shi", "す": "su", "せ": "se", "そ": "so",
+	"た": "ta", "ち": "chi", "つ": "tsu", "て": "te", "と": "to",
+	"な": "na", "に": "ni", "ぬ": "nu", "ね": "ne", "の": "no",
+	"は": "ha", "ひ": "hi", "ふ": "fu", "へ": "he", "ほ": "ho",
+	"ま": "ma", "み": "mi", "む": "mu", "め": "me", "も": "mo",
+	"や": "ya", "ゆ": "yu", "よ": "yo",
+	"ら": "ra", "り": "ri", "る": "ru", "れ": "re", "ろ": "ro",
+	"わ": "wa", "ゐ": "i", "ゑ": "e", "を": "o", "ん": "n",
+	"が": "ga", "ぎ": "gi", "ぐ": "gu", "げ": "ge", "ご": "go",
+	"ざ": "za", "じ": "ji", "ず": "zu", "ぜ": "ze", "ぞ": "zo",
+	"だ": "da", "ぢ": "ji", "づ": "zu", "で": "de", "ど": "do",
+	"ば": "ba", "び": "bi", "ぶ": "bu", "べ": "be", "ぼ": "bo",
+	"ぱ": "pa", "ぴ": "pi", "ぷ": "pu", "ぺ": "pe", "ぽ": "po",
+	"ゔ": "vu",
+	"ぁ": "a", "ぃ": "i", "ぅ": "u", "ぇ": "e", "ぉ": "o",
+	"ゃ": "ya", "ゅ": "yu", "ょ": "yo", "ゎ": "wa",
+	"きゃ": "kya", "きゅ": "kyu", "きょ": "kyo",
+	"しゃ": "sha", "しゅ": "shu", "しょ": "sho", "しぇ": "she",
+	"ちゃ": "cha", "ちゅ": "chu", "ちょ": "cho", "ちぇ": "che",
+	"にゃ": "nya", "にゅ": "nyu", "にょ": "nyo",
+	"ひゃ": "hya", "ひゅ": "hyu", "ひょ": "hyo",
+	"みゃ": "mya", "みゅ": "myu", "みょ": "myo",
+	"りゃ": "rya", "りゅ": "ryu", "りょ": "ryo",
+	"ぎゃ": "gya", "ぎゅ": "gyu", "ぎょ": "gyo",
+	"じゃ": "ja", "じゅ": "ju", "じょ": "jo", "じぇ": "je",
+	"ぢゃ": "ja", "ぢゅ": "ju", "ぢょ": "jo",
+	"びゃ": "bya", "びゅ": "byu", "びょ": "byo",
+	"ぴゃ": "pya", "ぴゅ": "pyu", "ぴょ": "pyo",
+	"ふぁ": "fa", "ふぃ": "fi", "ふぇ": "fe", "ふぉ": "fo",
+	"てぃ": "ti", "でぃ": "di", "とぅ": "tu", "どぅ": "du",
+	"うぃ": "wi", "うぇ": "we", "うぉ": "wo",
+	"ゔぁ": "va", "ゔぃ": "vi", "ゔぇ": "ve", "ゔぉ": "vo",
+}
+
+// カタカナをひらがなに変換する
+func katakanaToHiragana(r rune) rune {
+	if r >= 'ァ' && r <= 'ヶ' {
+		return r - 'ァ' + 'ぁ'
+	}
+	return r
+}
+
+// かなをヘボン式ローマ字に変換する。かな以外の文字は小文字にしてそのまま残す
+func kanaToRomaji(s string) string {
+	runes := []rune(s)
+	for i, r := range runes {
+		runes[i] = katakanaToHiragana(unicode.ToLower(r))
+	}
+
+	var b strings.Builder
+	isSokuon := false // 促音(っ)の後は次の子音を重ねる
+	lastVowel := ""
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		romaji, ok := "", false
+		if i+1 < len(runes) {
+			romaji, ok = kanaRomaji[string(runes[i:i+2])]
+			if ok {
+				i++
+			}
+		}
+		if !ok {
+			romaji, ok = kanaRomaji[string(r)]
+		}
+
+		switch {
+		case r == 'っ':
+			isSokuon = true
+			continue
+		case r == 'ー':
+			// 長音は直前の母音を重ねる
+			b.WriteString(lastVowel)
+			continue
+		case !ok:
+			b.WriteRune(r)
+			isSokuon, lastVowel = false, ""
+			continue
+		}
+		if isSokuon && strings.HasPrefix(romaji, "ch") {
+			// ヘボン式では"っち"を"tchi"と書く
+			b.WriteByte('t')
+		} else if isSokuon && romaji[0] != 'a' && romaji[0] != 'i' && romaji[0] != 'u' && romaji[0] != 'e' && romaji[0] != 'o' && romaji[0] != 'n' {
+			b.WriteByte(romaji[0])
+		}
+		b.WriteString(romaji)
+		isSokuon = false
+		lastVowel = romaji[len(romaji)-1:]
+	}
+	return b.String()
+}
+
+// ローマ字の表記揺れ(ヘボン式と訓令式等)をまとめる置換。同じ位置では前にあるものを優先する
+var romajiVariants = strings.NewReplacer(
+	"shi", "si", "sh", "sy",
+	"chi", "ti", "ch", "ty",
+	"tsu", "tu",
+	"fu", "hu",
+	"ji", "zi", "j", "zy",
+	"di", "zi", "du", "zu",
+	"wo", "o",
+	"mb", "nb", "mp", "np",
+	"ā", "a", "ī", "i", "ū", "u", "ē", "e", "ō", "o",
+	"â", "a", "î", "i", "û", "u", "ê", "e", "ô", "o",
+)
+
+var romajiLongVowels = strings.NewReplacer("ou", "o", "oo", "o", "uu", "u", "aa", "a", "ii", "i", "ee", "e", "nn", "n")
+
+// かなとローマ字の表記を比較するためのキー。空白と記号は取り除く
+// かなを含まないローマ字のタイトルにも同じ変換をかけ、表記揺れを吸収する
+func transliterationKey(s string) string {
+	romaji := kanaToRomaji(s)
+	var b strings.Builder
+	for _, r := range romaji {
+		if unicode.IsSpace(r) || unicode.IsPunct(r) || unicode.IsSymbol(r) {
+			continue
+		}
+		b.WriteRune(r)
+	}
+	key := romajiVariants.Replace(b.String())
+	// "ouu"のような連続にも対応するため、変化しなくなるまで繰り返す
+	for {
+		folded := romajiLongVowels.Replace(key)
+		if folded == key {
+			return key
+		}
+		key = folded
+	}
+}
+
+// かなを含むか
+func containsKana(s string) bool {
+	for _, r := range s {
+		if unicode.In(r, unicode.Hiragana, unicode.Katakana) {
+			return true
+		}
+	}
+	return false
+}
+
+// ローマ字にそろえたタイトルからDBのタイトルを引く索引
+// LIKEでは見つからない、かなとローマ字で書き分けられたタイトルの候補を探すために使う
+type transliterationIndex map[string][]string
+
+func buildTransliterationIndex(songs songSource, normalizer *titleNormalizer) (transliterationIndex, error) {
+	titles, err := songs.titles()
+	if err != nil {
+		return nil, err
+	}
+
+	index := transliterationIndex{}
+	for _, title := range titles {
+		if key := transliterationKey(normalizer.normalize(title)); key != "" {
+			index[key] = append(index[key], title)
+		}
+	}
+	return index, nil
+}
+
+// かなとローマ字の書き分けだけが異なるDBのタイトルを返す
+func (index transliterationIndex) search(title string) []string {
+	titles := []string{}
+	for _, t := range index[transliterationKey(title)] {
+		if containsKana(t) != containsKana(title) {
+			titles = append(titles, t)
+		}
+	}
+	return titles
+}
@@ -0,0 +1,97 @@
+package applysabun
+
+import "testing"
+
+func TestKanaToRomaji(t *testing.T) {
+	tests := []struct {
+		kana, want string
+	}{
+		{"さくら", "sakura"},
+		{"シンデレラ", "shinderera"},
+		{"がっこう", "gakkou"},
+		{"とうきょう", "toukyou"},
+		{"しんぶん", "shinbun"},
+		{"きゃりー", "kyarii"},
+		{"ラーメン", "raamen"},
+		{"まっちゃ", "matcha"},
+		{"ちょっと", "chotto"},
+		{"ファンタジー", "fantajii"},
+		{"ティーパーティー", "tiipaatii"},
+		{"ヴァイオリン", "vaiorin"},
+		{"じゅうでん", "juuden"},
+		{"っ", ""},
+		{"Aのうた 2", "anouta 2"},
+	}
+	for _, tt := range tests {
+		if got := kanaToRomaji(tt.kana); got != tt.want {
+			t.Errorf("kanaToRomaji(%q) = %q, want %q", tt.kana, got, tt.want)
+		}
+	}
+}
+
+func TestTransliterationKey(t *testing.T) {
+	// かなとローマ字の表記揺れは同じキーになる
+	sames := [][2]string{
+		{"がっこう", "Gakkou"},
+		{"がっこう", "Gakko"},
+		{"とうきょう", "Tokyo"},
+		{"とうきょう", "Toukyou"},
+		{"しんぶん", "Shimbun"},
+		{"しんぶん", "Sinbun"},
+		{"まっちゃ", "Matcha"},
+		{"ふじさん", "Huzisan"},
+		{"つばさ", "Tubasa"},
+		{"ラーメン", "Ramen"},
+		{"おおさか", "Ōsaka"},
+		{"きみをのせて", "Kimi o Nosete"},
+		{"さくら・さくら!", "Sakura Sakura"},
+	}
+	for _, pair := range sames {
+		if a, b := transliterationKey(pair[0]), transliterationKey(pair[1]); a != b {
+			t.Errorf("transliterationKey(%q) = %q, transliterationKey(%q) = %q, want the same", pair[0], a, pair[1], b)
+		}
+	}
+
+	differents := [][2]string{
+		{"さくら", "Sakana"},
+		{"しんぶん", "Shinbunshi"},
+		{"とうきょう", "Kyoto"},
+	}
+	for _, pair := range differents {
+		if a, b := transliterationKey(pair[0]), transliterationKey(pair[1]); a == b {
+			t.Errorf("transliterationKey(%q) and transliterationKey(%q) = %q, want different keys", pair[0], pair[1], a)
+		}
+	}
+}
+
+func TestTransliterationIndexSearch(t *testing.T) {
+	index := transliterationIndex{}
+	for _, title := range []string{"とうきょう", "Tokyo", "TOKYO", "さくら"} {
+		key := transliterationKey(title)
+		index[key] = append(index[key], title)
+	}
+	tests := []struct {
+		title string
+		want  []string
+	}{
+		// かなとローマ字の書き分けが異なるものだけを返す
+		{"Toukyou", []string{"とうきょう"}},
+		{"トウキョウ", []string{"Tokyo", "TOKYO"}},
+		{"Sakura", []string{"さくら"}},
+		{"さくら", []string{}},
+		{"Osaka", []string{}},
+	}
+	for _, tt := range tests {
+		got := index.search(tt.title)
+		if len(got) != len(tt.want) {
+			t.Errorf("search(%q) = %q, want %q", tt.title, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("search(%q) = %q, want %q", tt.title, got, tt.want)
+				break
+			}
+		}
+	}
+}
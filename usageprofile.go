@@ -0,0 +1,61 @@
+package applysabun
+
+// 小節ごとに、どの音源が配置されているかの集合
+// 同じ楽曲の差分なら、同じ音源を同じ小節で鳴らしているはず
+type usageProfile map[int]map[string]bool
+
+// BGMと、可視・不可視・ロングノートのキー音チャンネル
+func isKeysoundChannel(channel string) bool {
+	if channel == "01" {
+		return true
+	}
+	if len(channel) != 2 || channel[1] < '1' || channel[1] > '9' {
+		return false
+	}
+	switch channel[0] {
+	case '1', '2', '3', '4', '5', '6':
+		return true
+	}
+	return false
+}
+
+func makeUsageProfile(scan *bmsScan) usageProfile {
+	wavDefs := scan.WavDefs()
+	profile := usageProfile{}
+	for _, object := range scan.Objects {
+		if !isKeysoundChannel(object.Channel) {
+			continue
+		}
+		wavDef, ok := wavDefs[object.Value]
+		if !ok {
+			continue
+		}
+		if profile[object.Measure] == nil {
+			profile[object.Measure] = map[string]bool{}
+		}
+		profile[object.Measure][soundFileKey(wavDef)] = true
+	}
+	return profile
+}
+
+// (小節, 音源名)の組の集合のJaccard係数を0-1の類似度として返す
+func usageProfileSimilarity(p1, p2 usageProfile) float64 {
+	var sharedNum, unionNum int
+	for measure, names1 := range p1 {
+		names2 := p2[measure]
+		for name := range names1 {
+			if names2[name] {
+				sharedNum++
+			}
+		}
+		unionNum += len(names1)
+	}
+	for _, names2 := range p2 {
+		unionNum += len(names2)
+	}
+	unionNum -= sharedNum
+	if unionNum == 0 {
+		return 0
+	}
+	return float64(sharedNum) / float64(unionNum)
+}